@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"runtime"
 	"sync"
@@ -15,6 +16,12 @@ type M map[string]interface{}
 type Request struct {
 	Method string
 	Token  string
+	// Deadline is the time after which the client no longer wants the result.
+	// If it's not set, the default timeout of the method, if any, applies.
+	Deadline time.Time
+	// Coalesce is an optional key e.g. the method and file name. A newer request with the same key
+	// supersedes this one, it's dropped if it's still queued or canceled if it's running.
+	Coalesce string
 }
 
 type Response struct {
@@ -27,34 +34,119 @@ type Response struct {
 type Job struct {
 	Req *Request
 	Cl  Caller
+	Cx  *Ctx
+	// Reply, if set, receives the response instead of the client e.g. for calls made by the LSP server
+	Reply func(Response)
 }
 
 type Broker struct {
 	sync.Mutex
 
-	tag    string
-	served counter
-	start  time.Time
-	r      io.Reader
-	w      io.Writer
-	in     *bufio.Reader
-	out    *json.Encoder
+	id       uint64
+	tag      string
+	served   counter
+	start    time.Time
+	r        io.Reader
+	w        io.Writer
+	in       *bufio.Reader
+	out      *json.Encoder
+	calls    map[string]*Ctx
+	latest   map[string]*Ctx
+	callsLck sync.Mutex
+	pools    map[MethodClass]*pool
+	secret   string
+	authed   bool
+	logLevel LogLevel
+	logLck   sync.Mutex
+	caps     Caps
+	capsLck  sync.Mutex
+}
+
+var (
+	brokers    = map[*Broker]bool{}
+	brokersLck = sync.Mutex{}
+	// brokerIds numbers the brokers, i.e. the connections, e.g. to tell them apart in recordings
+	brokerIds = counter{}
+)
+
+// broadcast sends resp to the clients of all the brokers that are currently looping
+func broadcast(resp Response) {
+	brokersLck.Lock()
+	l := make([]*Broker, 0, len(brokers))
+	for b, _ := range brokers {
+		l = append(l, b)
+	}
+	brokersLck.Unlock()
+
+	for _, b := range l {
+		b.SendNoLog(resp)
+	}
 }
 
 func NewBroker(r io.Reader, w io.Writer, tag string) *Broker {
 	return &Broker{
-		tag: tag,
-		r:   r,
-		w:   w,
-		in:  bufio.NewReader(r),
-		out: json.NewEncoder(w),
+		id:       brokerIds.next(),
+		tag:      tag,
+		r:        r,
+		w:        w,
+		in:       bufio.NewReader(r),
+		out:      json.NewEncoder(w),
+		calls:    map[string]*Ctx{},
+		latest:   map[string]*Ctx{},
+		pools:    map[MethodClass]*pool{},
+		logLevel: LogOff,
 	}
 }
 
+// Caps returns the capabilities negotiated by the client
+func (b *Broker) Caps() Caps {
+	b.capsLck.Lock()
+	defer b.capsLck.Unlock()
+	return b.caps
+}
+
+// track registers cx and returns the request with the same coalesce key that it supersedes, if any.
+// callsLck must be held
+func (b *Broker) track(cx *Ctx) (prev *Ctx) {
+	if cx.coalesce != "" {
+		prev = b.latest[cx.coalesce]
+		b.latest[cx.coalesce] = cx
+	}
+
+	if cx.Token != "" {
+		b.calls[cx.Token] = cx
+	}
+	return prev
+}
+
+func (b *Broker) untrack(cx *Ctx) {
+	b.callsLck.Lock()
+	defer b.callsLck.Unlock()
+	if b.calls[cx.Token] == cx {
+		delete(b.calls, cx.Token)
+	}
+	if b.latest[cx.coalesce] == cx {
+		delete(b.latest, cx.coalesce)
+	}
+}
+
+// cancel cancels the queued or running request identified by token
+func (b *Broker) cancel(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	b.callsLck.Lock()
+	cx := b.calls[token]
+	b.callsLck.Unlock()
+
+	return cx.Cancel("canceled")
+}
+
 func (b *Broker) Send(resp Response) error {
 	err := b.SendNoLog(resp)
 	if err != nil {
-		logger.Println("Cannot send result", err)
+		b.logf(nil, LogError, M{"token": resp.Token, "error": err.Error()}, "Cannot send result")
 	}
 	return err
 }
@@ -72,6 +164,18 @@ func (b *Broker) SendNoLog(resp Response) error {
 	}
 
 	s, err := json.Marshal(resp)
+	if err == nil {
+		// the result is measured as it's encoded here rather than in the call, so it's only encoded once
+		if e := responseTooLarge(len(s)); e != "" {
+			resp = Response{
+				Token: resp.Token,
+				Tag:   resp.Tag,
+				Error: e,
+				Data:  M{},
+			}
+			s, err = json.Marshal(resp)
+		}
+	}
 	if err != nil {
 		// if there is a token, it means the client is waiting for a response
 		// so respond with the json error. cause of json encode failure includes: non-utf8 string
@@ -87,6 +191,8 @@ func (b *Broker) SendNoLog(resp Response) error {
 		}
 	}
 
+	trafficRec.response(b, resp)
+
 	// the only expected write failure are due to broken pipes
 	// which usually means the client has gone away so just ignore the error
 	b.w.Write(s)
@@ -94,43 +200,124 @@ func (b *Broker) SendNoLog(resp Response) error {
 	return nil
 }
 
-func (b *Broker) call(req *Request, cl Caller) {
-	b.served.next()
+// responseTooLarge returns an error if a response of n bytes is larger than responseSizeLimit
+func responseTooLarge(n int) string {
+	if limit := responseSizeLimit(); limit > 0 && n > limit {
+		return fmt.Sprintf("broker: the result is %d bytes, larger than the limit of %d bytes", n, limit)
+	}
+	return ""
+}
 
-	defer func() {
-		err := recover()
-		if err != nil {
-			buf := make([]byte, 64*1024*1024)
-			n := runtime.Stack(buf, true)
-			logger.Printf("%v#%v PANIC: %v\n%s\n\n", req.Method, req.Token, err, buf[:n])
-			b.Send(Response{
-				Token: req.Token,
-				Error: "broker: " + req.Method + "#" + req.Token + " PANIC",
-			})
+func (b *Broker) call(p *pool, job Job) {
+	req, cl, cx := job.Req, job.Cl, job.Cx
+	send := b.Send
+	if job.Reply != nil {
+		send = func(resp Response) error {
+			job.Reply(resp)
+			return nil
 		}
+	}
+
+	b.served.next()
+	defer b.untrack(cx)
+
+	if !cx.deadline.IsZero() && !time.Now().Before(cx.deadline) {
+		cx.Cancel("timeout")
+	}
+
+	if e := cx.Err(); e != "" {
+		b.recordFailure(req, cx)
+		send(Response{
+			Token: req.Token,
+			Error: e,
+		})
+		return
+	}
+
+	var timeout <-chan time.Time
+	if !cx.deadline.IsZero() {
+		t := time.NewTimer(cx.deadline.Sub(time.Now()))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	if !p.acquire(cx, timeout) {
+		cx.Cancel("timeout")
+		b.recordFailure(req, cx)
+		send(Response{
+			Token: req.Token,
+			Error: cx.Err(),
+		})
+		return
+	}
+
+	// the call runs in its own goroutine so a call that hangs past its deadline doesn't hold
+	// onto the worker. it's canceled and its result is discarded whenever it does return,
+	// until then it's counted as abandoned and holds onto its slot in the pool
+	resCh := make(chan Response, 1)
+	go func() {
+		defer p.release()
+		resCh <- b.exec(req, cl, cx)
 	}()
 
-	res, err := cl.Call()
+	select {
+	case resp := <-resCh:
+		send(resp)
+		return
+	case <-timeout:
+		cx.Cancel("timeout")
+	case <-cx.Done():
+	}
+
+	// canceled calls usually return right away, it's those that time out that are likely to be stuck
+	level := LogDebug
+	if cx.Err() == "timeout" {
+		level = LogWarn
+	}
+	n := p.abandon(resCh)
+	b.logf(req, level, M{"abandoned": n}, "Abandoned %s after it was %s, it's still running", req.Method, cx.Err())
+	b.recordFailure(req, cx)
+	send(Response{
+		Token: req.Token,
+		Error: cx.Err(),
+	})
+}
+
+// recordFailure records, for `stats`, a call that timed out or was canceled before it returned.
+// Its duration is the time since it was received
+func (b *Broker) recordFailure(req *Request, cx *Ctx) {
+	if cx.record() {
+		recordCall(req.Method, time.Now().Sub(cx.start), cx.Err(), false)
+	}
+}
+
+func (b *Broker) exec(req *Request, cl Caller, cx *Ctx) Response {
+	res, err := registry.Call(&Invocation{
+		B:   b,
+		Req: req,
+		Cx:  cx,
+		Cl:  cl,
+	})
 	if res == nil {
 		res = M{}
 	} else if v, ok := res.(M); ok && v == nil {
 		res = M{}
 	}
 
-	b.Send(Response{
+	return Response{
 		Token: req.Token,
 		Error: err,
 		Data:  res,
-	})
+	}
 }
 
-func (b *Broker) accept(jobsCh chan Job) (stopLooping bool) {
+func (b *Broker) accept() (stopLooping bool) {
 	line, err := b.in.ReadBytes('\n')
 
 	if err == io.EOF {
 		stopLooping = true
 	} else if err != nil {
-		logger.Println("Cannot read input", err)
+		b.logf(nil, LogError, nil, "Cannot read input: %v", err)
 		b.Send(Response{
 			Error: err.Error(),
 		})
@@ -138,24 +325,64 @@ func (b *Broker) accept(jobsCh chan Job) (stopLooping bool) {
 	}
 
 	req := &Request{}
+	header := json.RawMessage{}
 	dec := json.NewDecoder(bytes.NewReader(line))
 	// if this fails, we are unable to return a useful error(no token to send it to)
 	// so we'll simply/implicitly drop the request since it has no method
 	// we can safely assume that all such cases will be empty lines and not an actual request
-	dec.Decode(&req)
+	if dec.Decode(&header) != nil {
+		return
+	}
+
+	if err := json.Unmarshal(header, req); err != nil {
+		// nothing but a valid `hello` is answered before the client is authorized
+		if b.secret != "" && !b.authed {
+			return true
+		}
+
+		// e.g. an invalid deadline, the method and token are still enough to reply
+		id := struct{ Method, Token string }{}
+		json.Unmarshal(header, &id)
+		if id.Method != "" {
+			b.Send(Response{
+				Token: id.Token,
+				Error: "broker: invalid request: " + err.Error(),
+			})
+		}
+		return
+	}
 
 	if req.Method == "" {
 		return
 	}
 
+	if !b.authorized(req, line) {
+		// the client is either misconfigured or guessing so there's no point continuing
+		b.Send(Response{
+			Token: req.Token,
+			Error: "broker: unauthorized, the first request must be `hello` with the shared `secret`",
+		})
+		return true
+	}
+
+	trafficRec.request(b, req, line)
+
 	if req.Method == "bye-ni" {
 		return true
 	}
 
+	if !req.Deadline.IsZero() && !time.Now().Before(req.Deadline) {
+		b.Send(Response{
+			Token: req.Token,
+			Error: "deadline exceeded",
+		})
+		return
+	}
+
 	m := registry.Lookup(req.Method)
 	if m == nil {
 		e := "Invalid method " + req.Method
-		logger.Println(e)
+		b.logf(req, LogWarn, nil, "%s", e)
 		b.Send(Response{
 			Token: req.Token,
 			Error: e,
@@ -166,7 +393,7 @@ func (b *Broker) accept(jobsCh chan Job) (stopLooping bool) {
 	cl := m(b)
 	err = dec.Decode(cl)
 	if err != nil {
-		logger.Println("Cannot decode arg", err)
+		b.logf(req, LogWarn, nil, "Cannot decode arg: %v", err)
 		b.Send(Response{
 			Token: req.Token,
 			Error: err.Error(),
@@ -174,49 +401,145 @@ func (b *Broker) accept(jobsCh chan Job) (stopLooping bool) {
 		return
 	}
 
-	jobsCh <- Job{
+	// capabilities are applied here rather than in the call so they're in effect for the very next request
+	if h, ok := cl.(*mHello); ok {
+		// don't echo the secret back to the client
+		delete(*h, "secret")
+		b.negotiate(*h)
+	}
+
+	// cancel is needed most when the pools are saturated, so it's called right away instead of being queued
+	if _, ok := cl.(*mCancel); ok {
+		b.Send(b.exec(req, cl, newCtx(b, req)))
+		return
+	}
+
+	e := b.enqueue(Job{
 		Req: req,
 		Cl:  cl,
+		Cx:  newCtx(b, req),
+	})
+	if e != "" {
+		b.Send(Response{
+			Token: req.Token,
+			Error: e,
+		})
 	}
 
 	return
 }
 
-func (b *Broker) worker(wg *sync.WaitGroup, jobsCh chan Job) {
-	defer wg.Done()
-	for job := range jobsCh {
-		b.call(job.Req, job.Cl)
+// enqueue adds job to the queue of the pool of its method and tracks its call.
+// If the queue is full, it returns an error instead and the request it would've superseded is left alone
+func (b *Broker) enqueue(job Job) string {
+	// the job is tracked while the lock is held so the worker can't untrack it first
+	b.callsLck.Lock()
+	p := b.pools[registry.Class(job.Req.Method)]
+	if p == nil || !p.enqueue(job) {
+		b.callsLck.Unlock()
+		e := "broker: " + registry.Class(job.Req.Method).String() + " queue is full"
+		b.logf(job.Req, LogWarn, nil, "%s", e)
+		recordRejected(job.Req.Method)
+		return e
+	}
+	prev := b.track(job.Cx)
+	b.callsLck.Unlock()
+
+	prev.Cancel("superseded")
+	return ""
+}
+
+// startPools starts the workers of a pool for each class of method
+func (b *Broker) startPools(wg *sync.WaitGroup) {
+	for _, class := range methodClasses {
+		p := newPool(class)
+		b.pools[class] = p
+		p.start(b, wg)
+	}
+}
+
+// stopPools stops the workers once they've called the jobs that are already queued
+func (b *Broker) stopPools() {
+	for _, p := range b.pools {
+		p.stop()
+	}
+}
+
+// status returns the state of each pool of workers
+func (b *Broker) status() M {
+	m := M{}
+	for class, p := range b.pools {
+		m[class.String()] = p.status()
+	}
+	return m
+}
+
+// queueDepths returns the number of requests queued in each class of pool by all the brokers
+func queueDepths() M {
+	brokersLck.Lock()
+	defer brokersLck.Unlock()
+
+	n := map[MethodClass]int{}
+	for b, _ := range brokers {
+		for class, p := range b.pools {
+			n[class] += len(p.jobs)
+		}
+	}
+
+	m := M{}
+	for _, class := range methodClasses {
+		m[class.String()] = n[class]
+	}
+	return m
+}
+
+// utilisation returns the fraction of the broker's workers that are busy
+func (b *Broker) utilisation() float64 {
+	busy := 0
+	workers := 0
+	for _, p := range b.pools {
+		p.lck.Lock()
+		busy += p.busy
+		p.lck.Unlock()
+		workers += p.workers
 	}
+	if workers == 0 {
+		return 0
+	}
+	return float64(busy) / float64(workers)
 }
 
 func (b *Broker) Loop(decorate bool, wait bool) {
 	b.start = time.Now()
 
+	brokersLck.Lock()
+	brokers[b] = true
+	brokersLck.Unlock()
+
+	defer func() {
+		brokersLck.Lock()
+		delete(brokers, b)
+		brokersLck.Unlock()
+	}()
+
 	if decorate {
 		go b.SendNoLog(Response{
 			Token: "margo.hello",
-			Data: M{
-				"time": b.start.String(),
-			},
+			Data:  b.helloData(),
 		})
 	}
 
-	const workers = 20
 	wg := &sync.WaitGroup{}
-	jobsCh := make(chan Job, 1000)
-	for i := 0; i < workers; i += 1 {
-		wg.Add(1)
-		go b.worker(wg, jobsCh)
-	}
+	b.startPools(wg)
 
 	for {
-		stopLooping := b.accept(jobsCh)
+		stopLooping := b.accept()
 		if stopLooping {
 			break
 		}
 		runtime.Gosched()
 	}
-	close(jobsCh)
+	b.stopPools()
 
 	if wait {
 		wg.Wait()
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"go/build"
+	"go/build/constraint"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// buildFilter decides which files are part of a package, the same way `go build` does,
+// from their file names and `//go:build` or `// +build` constraints
+type buildFilter struct {
+	GOOS   string
+	GOARCH string
+	Cgo    bool
+	// Tags are the tags set by the client e.g. using `-tags` in GOFLAGS
+	Tags map[string]bool
+	// GoMinor is the minor version of the toolchain, go1.1 through go1.GoMinor are satisfied
+	GoMinor int
+}
+
+// BuildOptions select the configuration that code is analysed for, like the flags of `go build`.
+// Fields that aren't set default to the values in the Env
+type BuildOptions struct {
+	// Tags replace those set by `-tags` in GOFLAGS unless they're nil
+	Tags   []string
+	GOOS   string
+	GOARCH string
+	// Cgo replaces CGO_ENABLED unless it's nil
+	Cgo *bool
+}
+
+// newBuildFilter returns a filter for the GOOS, GOARCH, CGO_ENABLED, GOVERSION and GOFLAGS in env,
+// each defaulting to the values margo was built with, overridden by those set in bo
+func newBuildFilter(env map[string]string, bo BuildOptions) *buildFilter {
+	bf := &buildFilter{
+		GOOS:    orString(bo.GOOS, env["GOOS"], runtime.GOOS),
+		GOARCH:  orString(bo.GOARCH, env["GOARCH"], runtime.GOARCH),
+		Cgo:     build.Default.CgoEnabled,
+		Tags:    map[string]bool{},
+		GoMinor: goMinorVersion(orString(env["GOVERSION"], runtime.Version())),
+	}
+	if s := env["CGO_ENABLED"]; s != "" {
+		bf.Cgo = s == "1"
+	}
+	if bo.Cgo != nil {
+		bf.Cgo = *bo.Cgo
+	}
+
+	tags := goflagsTags(env["GOFLAGS"])
+	if bo.Tags != nil {
+		// like -tags, each may be a comma-separated list
+		tags = splitTags(strings.Join(bo.Tags, ","))
+	}
+	for _, tag := range tags {
+		bf.Tags[tag] = true
+	}
+	return bf
+}
+
+// goflagsTags returns the tags set by `-tags` in goflags
+func goflagsTags(goflags string) []string {
+	tags := []string{}
+	l := strings.Fields(goflags)
+	for i, s := range l {
+		s = strings.TrimPrefix(s, "-")
+		switch {
+		case strings.HasPrefix(s, "-tags="), strings.HasPrefix(s, "tags="):
+			s = s[strings.Index(s, "=")+1:]
+		case (s == "-tags" || s == "tags") && i+1 < len(l):
+			s = l[i+1]
+		default:
+			continue
+		}
+		tags = append(tags, splitTags(s)...)
+	}
+	return tags
+}
+
+// splitTags splits the value of a `-tags` flag into the tags it lists
+func splitTags(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// goMinorVersion returns N of a version like `go1.N.2` or `devel go1.N-abcdef`
+func goMinorVersion(version string) int {
+	i := strings.Index(version, "go1.")
+	if i < 0 {
+		return 0
+	}
+	s := version[i+len("go1."):]
+	end := 0
+	for end < len(s) && '0' <= s[end] && s[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
+
+// MatchTag reports whether tag is satisfied
+func (bf *buildFilter) MatchTag(tag string) bool {
+	switch {
+	case tag == bf.GOOS, tag == bf.GOARCH, tag == runtime.Compiler:
+		return true
+	case tag == "unix":
+		return unixOS[bf.GOOS]
+	case tag == "linux" && bf.GOOS == "android",
+		tag == "solaris" && bf.GOOS == "illumos",
+		tag == "darwin" && bf.GOOS == "ios":
+		// these are supersets of the OS they're named after
+		return true
+	case tag == "cgo":
+		return bf.Cgo
+	case strings.HasPrefix(tag, "go1."):
+		if n, err := strconv.Atoi(tag[len("go1."):]); err == nil && n >= 1 {
+			return n <= bf.GoMinor
+		}
+	}
+	return bf.Tags[tag]
+}
+
+// MatchName reports whether the GOOS and GOARCH suffixes of the file name, if any, are satisfied e.g. `x_linux_amd64.go`
+func (bf *buildFilter) MatchName(name string) bool {
+	if dot := strings.Index(name, "."); dot >= 0 {
+		name = name[:dot]
+	}
+	// a file called e.g. linux.go isn't constrained, only those with a suffix
+	i := strings.Index(name, "_")
+	if i < 0 {
+		return true
+	}
+
+	l := strings.Split(name[i:], "_")
+	if n := len(l); n > 0 && l[n-1] == "test" {
+		l = l[:n-1]
+	}
+	n := len(l)
+	if n >= 2 && knownOS[l[n-2]] && knownArch[l[n-1]] {
+		return bf.MatchTag(l[n-2]) && bf.MatchTag(l[n-1])
+	}
+	if n >= 1 && (knownOS[l[n-1]] || knownArch[l[n-1]]) {
+		return bf.MatchTag(l[n-1])
+	}
+	return true
+}
+
+// MatchSrc reports whether the build constraints in the header of src, the content of a Go file, are satisfied.
+// A `//go:build` line takes precedence over `// +build` lines, like in `go build`
+func (bf *buildFilter) MatchSrc(src []byte) bool {
+	var goBuild constraint.Expr
+	plusBuild := []constraint.Expr{}
+	// legacy +build lines only count if they're followed by a blank line, otherwise they're part of the package doc
+	block := []constraint.Expr{}
+	inComment := false
+
+header:
+	for len(src) > 0 {
+		line := src
+		if i := bytes.IndexByte(src, '\n'); i >= 0 {
+			line, src = src[:i], src[i+1:]
+		} else {
+			src = nil
+		}
+		line = bytes.TrimSpace(line)
+
+		switch {
+		case inComment:
+			if i := bytes.Index(line, []byte("*/")); i >= 0 {
+				inComment = false
+				if len(bytes.TrimSpace(line[i+2:])) > 0 {
+					break header
+				}
+			}
+		case len(line) == 0:
+			plusBuild = append(plusBuild, block...)
+			block = block[:0]
+		case bytes.HasPrefix(line, []byte("//")):
+			s := string(line)
+			switch {
+			case constraint.IsGoBuild(s):
+				if x, err := constraint.Parse(s); err == nil && goBuild == nil {
+					goBuild = x
+				}
+			case constraint.IsPlusBuild(s):
+				if x, err := constraint.Parse(s); err == nil {
+					block = append(block, x)
+				}
+			}
+		case bytes.HasPrefix(line, []byte("/*")):
+			block = block[:0]
+			inComment = !bytes.Contains(line[2:], []byte("*/"))
+		default:
+			break header
+		}
+	}
+
+	if goBuild != nil {
+		return goBuild.Eval(bf.MatchTag)
+	}
+	for _, x := range plusBuild {
+		if !x.Eval(bf.MatchTag) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchFile reports whether the Go file fn is part of its package
+func (bf *buildFilter) MatchFile(fn string) bool {
+	if !bf.MatchName(filepath.Base(fn)) {
+		return false
+	}
+	src, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return false
+	}
+	return bf.MatchSrc(src)
+}
+
+// OSArch returns the name of the directory in which packages built for bf are installed e.g. `linux_amd64`
+func (bf *buildFilter) OSArch() string {
+	return bf.GOOS + "_" + bf.GOARCH
+}
+
+// Context returns a build.Context that selects the same files as bf,
+// for code that uses go/build to list the files of packages
+func (bf *buildFilter) Context() *build.Context {
+	ctx := build.Default
+	ctx.GOOS = bf.GOOS
+	ctx.GOARCH = bf.GOARCH
+	ctx.CgoEnabled = bf.Cgo
+	ctx.BuildTags = []string{}
+	for tag, ok := range bf.Tags {
+		if ok {
+			ctx.BuildTags = append(ctx.BuildTags, tag)
+		}
+	}
+	ctx.ReleaseTags = []string{}
+	for i := 1; i <= bf.GoMinor; i++ {
+		ctx.ReleaseTags = append(ctx.ReleaseTags, "go1."+strconv.Itoa(i))
+	}
+	return &ctx
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"unicode/utf8"
 )
@@ -78,6 +79,16 @@ func envSlice(envMap map[string]string) []string {
 	return env
 }
 
+// envKeys returns the sorted names of the variables in env
+func envKeys(env map[string]string) []string {
+	l := make([]string, 0, len(env))
+	for k, _ := range env {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l
+}
+
 func defaultEnv() map[string]string {
 	return map[string]string{
 		"GOROOT": runtime.GOROOT(),
@@ -86,6 +97,33 @@ func defaultEnv() map[string]string {
 	}
 }
 
+// processEnv returns the defaultEnv overridden by environ.
+// It describes MarGo's environment, commands should be run with environ instead
+func processEnv() map[string]string {
+	m := defaultEnv()
+	for k, v := range environ() {
+		m[k] = v
+	}
+	return m
+}
+
+// environ returns the environment of this process overridden by the Env of the config
+func environ() map[string]string {
+	m := map[string]string{}
+	for _, s := range os.Environ() {
+		p := strings.SplitN(s, "=", 2)
+		if len(p) == 2 {
+			m[p[0]] = p[1]
+		} else {
+			m[p[0]] = ""
+		}
+	}
+	for k, v := range configEnv() {
+		m[k] = v
+	}
+	return m
+}
+
 func orString(a ...string) string {
 	for _, s := range a {
 		if s != "" {
@@ -132,8 +170,16 @@ func fiHasGoExt(fi os.FileInfo) bool {
 	return strings.HasSuffix(fi.Name(), ".go")
 }
 
-func parsePkg(fset *token.FileSet, srcDir string, mode parser.Mode) (pkg *ast.Package, pkgs map[string]*ast.Package, err error) {
-	if pkgs, err = parser.ParseDir(fset, srcDir, fiHasGoExt, mode); pkgs != nil {
+// parsePkg parses the package in srcDir. If bf is not nil, the files it excludes are skipped
+func parsePkg(fset *token.FileSet, srcDir string, bf *buildFilter, mode parser.Mode) (pkg *ast.Package, pkgs map[string]*ast.Package, err error) {
+	filter := fiHasGoExt
+	if bf != nil {
+		filter = func(fi os.FileInfo) bool {
+			return fiHasGoExt(fi) && bf.MatchFile(filepath.Join(srcDir, fi.Name()))
+		}
+	}
+
+	if pkgs, err = parser.ParseDir(fset, srcDir, filter, mode); pkgs != nil {
 		_, pkgName := filepath.Split(srcDir)
 		// we aren't going to support package whose name don't match the directory unless it's main
 		p, ok := pkgs[pkgName]
@@ -162,7 +208,7 @@ func rootDirs(env map[string]string) []string {
 	} else if fn := os.Getenv("GOROOT"); fn != "" {
 		gorootBase = fn
 	}
-	goroot := filepath.Join(gorootBase, "src", "pkg")
+	goroot := gorootSrc(gorootBase)
 
 	dirsSeen := map[string]bool{}
 	for _, fn := range filepath.SplitList(gopath) {
@@ -187,10 +233,18 @@ func rootDirs(env map[string]string) []string {
 	return dirs
 }
 
-func findPkg(fset *token.FileSet, importPath string, dirs []string, mode parser.Mode) (pkg *ast.Package, pkgs map[string]*ast.Package, err error) {
+// findPkg parses the package importPath. If mr is not nil, it's used to find the package first
+// otherwise, or if that fails, the package is looked for in each of dirs
+func findPkg(fset *token.FileSet, importPath string, mr *modResolver, dirs []string, bf *buildFilter, mode parser.Mode) (pkg *ast.Package, pkgs map[string]*ast.Package, err error) {
+	if dir, ok := mr.Dir(importPath); ok {
+		if pkg, pkgs, err = parsePkg(fset, dir, bf, mode); pkg != nil {
+			return
+		}
+	}
+
 	for _, dir := range dirs {
 		srcDir := filepath.Join(dir, importPath)
-		if pkg, pkgs, err = parsePkg(fset, srcDir, mode); pkg != nil {
+		if pkg, pkgs, err = parsePkg(fset, srcDir, bf, mode); pkg != nil {
 			return
 		}
 	}
@@ -216,11 +270,16 @@ func tempDir(env map[string]string, subDirs ...string) string {
 		}
 	}
 
+	args := []string{dir, "GoSublime-temp"}
 	if dir == "" {
-		dir = os.TempDir()
+		if s := currentConfig().TempDir; s != "" {
+			args = []string{s}
+		} else {
+			args[0] = os.TempDir()
+		}
 	}
 
-	args := append([]string{dir, "GoSublime-temp"}, subDirs...)
+	args = append(args, subDirs...)
 	dir = filepath.Join(args...)
 	os.MkdirAll(dir, 0777)
 
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Config is the content of the config file, see `-config`.
+// Settings that are zero are left at their built-in defaults and
+// flags set on the command line take precedence over the config.
+type Config struct {
+	// Oom and OomSoft are the memory limits, in megabytes, see `-oom` and `-oom-soft`
+	Oom     int `json:"oom"`
+	OomSoft int `json:"oom_soft"`
+	// Poll, Tag and Wait are the same as the flags of the same name, they only take effect at startup
+	Poll int    `json:"poll"`
+	Tag  string `json:"tag"`
+	Wait *bool  `json:"wait"`
+
+	Gomaxprocs int                   `json:"gomaxprocs"`
+	Pools      map[string]configPool `json:"pools"`
+	// TempDir replaces the GoSublime-temp directory in the system's temp directory
+	TempDir string `json:"temp_dir"`
+	// Env holds values that take precedence over margo's own environment when a method is called without an `Env`
+	Env map[string]string `json:"env"`
+	// Timeouts holds the default timeouts of methods e.g. `{"lint": "5s"}`
+	Timeouts map[string]string `json:"timeouts"`
+	// LintFilter holds the kinds of lint reports that are never reported e.g. `gs.flag.parse`
+	LintFilter      []string `json:"lint_filter"`
+	MaxResponseSize int      `json:"max_response_size"`
+
+	timeouts map[string]time.Duration
+}
+
+type configPool struct {
+	Workers int `json:"workers"`
+	Queue   int `json:"queue"`
+}
+
+var (
+	cfg    = &Config{}
+	cfgFn  = ""
+	cfgLck = sync.Mutex{}
+
+	// cmdlineFlags are the names of the flags set on the command line
+	cmdlineFlags = map[string]bool{}
+)
+
+// defaultConfigFn returns the name of the config file used if `-config` isn't set
+func defaultConfigFn() string {
+	home := os.Getenv("XDG_CONFIG_HOME")
+	if home == "" {
+		home = os.Getenv("HOME")
+		if home == "" {
+			return ""
+		}
+		home = filepath.Join(home, ".config")
+	}
+	return filepath.Join(home, "margo", "config.json")
+}
+
+// readConfig reads and validates the config file fn
+func readConfig(fn string) (*Config, error) {
+	c := &Config{}
+	if err := readJsonFile(fn, c); err != nil {
+		return nil, err
+	}
+
+	c.timeouts = map[string]time.Duration{}
+	for name, s := range c.Timeouts {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid timeout for %s: %v", fn, name, err)
+		}
+		c.timeouts[name] = d
+	}
+
+	for name, _ := range c.Pools {
+		if _, ok := parseMethodClass(name); !ok {
+			return nil, fmt.Errorf("%s: unknown pool %s", fn, name)
+		}
+	}
+	return c, nil
+}
+
+// loadConfig reads the config file fn and applies it.
+// If fn is empty, the default config file is used, if it exists.
+func loadConfig(fn string) (*Config, error) {
+	if fn == "" {
+		fn = defaultConfigFn()
+		if _, err := os.Stat(fn); fn == "" || err != nil {
+			c := currentConfig()
+			applyConfig(c)
+			return c, nil
+		}
+	}
+
+	c, err := readConfig(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	cfgLck.Lock()
+	cfg = c
+	cfgFn = fn
+	cfgLck.Unlock()
+
+	applyConfig(c)
+	return c, nil
+}
+
+// reloadConfig reads the config file used at startup again
+func reloadConfig() (string, *Config, error) {
+	cfgLck.Lock()
+	fn := cfgFn
+	cfgLck.Unlock()
+
+	if fn == "" {
+		return "", nil, errors.New("margo wasn't started with a config file")
+	}
+	c, err := loadConfig(fn)
+	return fn, c, err
+}
+
+// applyConfig applies the settings of c that can be changed while margo is running
+func applyConfig(c *Config) {
+	if c.Gomaxprocs > 0 {
+		runtime.GOMAXPROCS(c.Gomaxprocs)
+	} else {
+		// 4 is arbitrary,
+		runtime.GOMAXPROCS(runtime.NumCPU() + 4)
+	}
+
+	// limits that are removed from the config go back to those of the flags
+	mb, soft := oomFlagLimits()
+	if !cmdlineFlags["oom"] && c.Oom > 0 {
+		mb = c.Oom
+	}
+	if !cmdlineFlags["oom-soft"] && c.OomSoft > 0 {
+		soft = c.OomSoft
+	}
+	setOomLimit(mb)
+	setOomSoftLimit(soft)
+}
+
+func currentConfig() *Config {
+	cfgLck.Lock()
+	defer cfgLck.Unlock()
+	return cfg
+}
+
+// methodTimeout returns the default timeout of method
+func methodTimeout(method string) time.Duration {
+	if d, ok := currentConfig().timeouts[method]; ok {
+		return d
+	}
+	if d, ok := methodTimeouts[method]; ok {
+		return d
+	}
+	if registry.Class(method) == Spawning {
+		return spawningTimeout
+	}
+	return 0
+}
+
+// responseSizeLimit returns the size, in bytes, of the largest result a method may return
+func responseSizeLimit() int {
+	if n := currentConfig().MaxResponseSize; n > 0 {
+		return n
+	}
+	return maxResponseSize
+}
+
+// configEnv returns the Env set in the config
+func configEnv() map[string]string {
+	return currentConfig().Env
+}
+
+// poolSize returns the number of workers and queue capacity of the pools of class
+func poolSize(class MethodClass) (workers, queue int) {
+	sz := poolSizes[class]
+	workers, queue = sz.workers, sz.queue
+	if p, ok := currentConfig().Pools[class.String()]; ok {
+		if p.Workers > 0 {
+			workers = p.Workers
+		}
+		if p.Queue > 0 {
+			queue = p.Queue
+		}
+	}
+	return
+}
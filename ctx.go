@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// spawningTimeout is the default timeout of Spawning methods e.g. `sh` and `play` that don't have
+	// their own. They may run for as long as the user wants them to, but without a limit a few watchers
+	// or builds that never end would hold onto every worker of the pool. Clients set a later deadline
+	// for commands that are expected to run for longer.
+	spawningTimeout = 10 * time.Minute
+
+	// methodTimeouts are the default timeouts of requests that don't specify a deadline.
+	methodTimeouts = map[string]time.Duration{
+		"doc":             20 * time.Second,
+		"doc2":            20 * time.Second,
+		"declarations":    20 * time.Second,
+		"lint":            20 * time.Second,
+		"gocode_complete": 10 * time.Second,
+		"gocode_calltip":  10 * time.Second,
+		"fmt":             10 * time.Second,
+		"imports":         10 * time.Second,
+		"pkg":             10 * time.Second,
+		"import_paths":    60 * time.Second,
+		"pkgpaths":        60 * time.Second,
+		"pkg_dirs":        60 * time.Second,
+		"pkgdoc":          30 * time.Second,
+		"share":           30 * time.Second,
+	}
+)
+
+// Ctx holds the state of a single request for the duration of its call.
+// A nil *Ctx is valid and is never canceled.
+type Ctx struct {
+	Method string
+	Token  string
+	// Caps are the capabilities of the client that made the request
+	Caps Caps
+
+	b        *Broker
+	deadline time.Time
+	coalesce string
+	env      map[string]string
+	start    time.Time
+	recorded bool
+	lck      sync.Mutex
+	done     chan struct{}
+	err      string
+}
+
+func newCtx(b *Broker, req *Request) *Ctx {
+	cx := &Ctx{
+		Method:   req.Method,
+		Token:    req.Token,
+		b:        b,
+		deadline: req.Deadline,
+		coalesce: req.Coalesce,
+		start:    time.Now(),
+		done:     make(chan struct{}),
+	}
+	if b != nil {
+		cx.Caps = b.Caps()
+	}
+	if d := methodTimeout(req.Method); cx.deadline.IsZero() && d > 0 {
+		cx.deadline = time.Now().Add(d)
+	}
+	return cx
+}
+
+// setClientEnv remembers env, the Env of the request as the client sent it, before it's filled in
+func (cx *Ctx) setClientEnv(env map[string]string) {
+	if cx != nil {
+		cx.env = copyEnv(env)
+	}
+}
+
+// clientEnv returns the Env of the request as the client sent it e.g. for commands
+// that should run in the client's environment rather than the one used for analysis
+func (cx *Ctx) clientEnv() map[string]string {
+	if cx == nil {
+		return nil
+	}
+	return cx.env
+}
+
+// record returns true the first time it's called. The outcome of a call is recorded by whichever of
+// the call or the broker, if it gives up on the call, is first so that it's only counted once
+func (cx *Ctx) record() bool {
+	if cx == nil {
+		return true
+	}
+
+	cx.lck.Lock()
+	defer cx.lck.Unlock()
+
+	if cx.recorded {
+		return false
+	}
+	cx.recorded = true
+	return true
+}
+
+// Done returns a channel that's closed when the request is canceled
+func (cx *Ctx) Done() <-chan struct{} {
+	if cx == nil {
+		return nil
+	}
+	return cx.done
+}
+
+// Cancel cancels the request, reason is sent to the client in place of the result.
+// It returns false if the request was already canceled.
+func (cx *Ctx) Cancel(reason string) bool {
+	if cx == nil {
+		return false
+	}
+
+	cx.lck.Lock()
+	defer cx.lck.Unlock()
+
+	if cx.err != "" {
+		return false
+	}
+	cx.err = reason
+	close(cx.done)
+	return true
+}
+
+// Canceled returns true if the request was canceled and any work done on its behalf should stop
+func (cx *Ctx) Canceled() bool {
+	return cx.Err() != ""
+}
+
+// Err returns the reason the request was canceled or an empty string if it wasn't
+func (cx *Ctx) Err() string {
+	if cx == nil {
+		return ""
+	}
+
+	cx.lck.Lock()
+	defer cx.lck.Unlock()
+	return cx.err
+}
+
+// child returns the Ctx of a call of method made on behalf of the request e.g. a step of a batch.
+// It has the default timeout of method, if any, and is canceled when the request is.
+// stop must be called once the call returns
+func (cx *Ctx) child(method string) (ch *Ctx, stop func()) {
+	ch = newCtx(cx.b, &Request{Method: method, Token: cx.Token})
+	ch.Caps = cx.Caps
+	if !cx.deadline.IsZero() && (ch.deadline.IsZero() || cx.deadline.Before(ch.deadline)) {
+		ch.deadline = cx.deadline
+	}
+
+	stopCh := make(chan struct{})
+	go func() {
+		var timeout <-chan time.Time
+		if !ch.deadline.IsZero() {
+			t := time.NewTimer(ch.deadline.Sub(time.Now()))
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case <-cx.Done():
+			ch.Cancel(cx.Err())
+		case <-timeout:
+			ch.Cancel("timeout")
+		case <-stopCh:
+		}
+	}()
+	return ch, func() { close(stopCh) }
+}
@@ -162,17 +162,19 @@ func setCustomContexts() {
 }
 
 type goApi struct {
-	Fn        string
-	Src       string
-	Env       map[string]string
-	Offset    int
-	TabIndent bool
-	TabWidth  int
+	Fn           string
+	Src          string
+	Env          map[string]string
+	BuildOptions BuildOptions
+	Offset       int
+	TabIndent    bool
+	TabWidth     int
 }
 
-func (m *goApi) Call() (interface{}, string) {
+func (m *goApi) Call(cx *Ctx) (interface{}, string) {
 	res := []*Doc{}
 
+	m.Offset = cx.byteOffset(m.Src, m.Offset, "utf-8")
 	if runtime.GOOS == "windows" {
 		if m.Offset > len(m.Src) {
 			m.Offset = len(m.Src)
@@ -185,20 +187,17 @@ func (m *goApi) Call() (interface{}, string) {
 	pkgs := []string{dir}
 	line := fmt.Sprintf("%s:%d", file, m.Offset)
 
-	context := &build.Context{}
+	context := newBuildFilter(m.Env, m.BuildOptions).Context()
 	contexts := []*build.Context{context}
 	context.GOROOT = m.Env["GOROOT"]
 	context.GOPATH = m.Env["GOPATH"]
-	context.GOOS = m.Env["GOOS"]
-	context.GOARCH = m.Env["GOARCH"]
-	context.CgoEnabled = m.Env["CGO_ENABLED"] == "1"
 
-	if context.GOOS == "" {
-		context.GOOS = runtime.GOOS
+	mr := newModResolver(dir, m.Env)
+	pos, info := GoApi(cx, mr, &line, pkgs, contexts)
+	if cx.Canceled() {
+		return res, cx.Err()
 	}
 
-	pos, info := GoApi(&line, pkgs, contexts)
-
 	if pos.IsValid() {
 		doc := &Doc{}
 		doc.Col = pos.Column - 1
@@ -213,7 +212,7 @@ func (m *goApi) Call() (interface{}, string) {
 	return res, ""
 }
 
-func GoApi(lookupCursorInfo *string, pkgs []string, contexts []*build.Context) (thePos token.Position, theInfo *TypeInfo) {
+func GoApi(cx *Ctx, mr *modResolver, lookupCursorInfo *string, pkgs []string, contexts []*build.Context) (thePos token.Position, theInfo *TypeInfo) {
 	// flag.Usage = usage
 	// flag.Parse()
 
@@ -282,6 +281,8 @@ func GoApi(lookupCursorInfo *string, pkgs []string, contexts []*build.Context) (
 
 	var features []string
 	w := NewWalker()
+	w.cx = cx
+	w.mod = mr
 	if curinfo.pkg != "" {
 		w.cursorInfo = &curinfo
 	}
@@ -320,6 +321,9 @@ func GoApi(lookupCursorInfo *string, pkgs []string, contexts []*build.Context) (
 
 				goto lookup
 			}
+			if w.canceled() {
+				return
+			}
 		}
 
 		for pkg, p := range w.packageMap {
@@ -823,6 +827,8 @@ type Walker struct {
 	wantedPkg       map[string]bool   // packages requested on the command line
 	cursorInfo      *CursorInfo
 	localvar        map[string]*ExprType
+	cx              *Ctx
+	mod             *modResolver // resolves imports inside a module, nil outside
 }
 
 func NewWalker() *Walker {
@@ -839,6 +845,12 @@ func NewWalker() *Walker {
 	}
 }
 
+// canceled reports whether the request the walker works for was canceled.
+// Walking stops at the next package or file once it returns true.
+func (w *Walker) canceled() bool {
+	return w.cx.Canceled()
+}
+
 // loadState is the state of a package's parsing.
 type loadState int
 
@@ -909,6 +921,10 @@ func (w *Walker) findPackageOSArch(pkg string) *Package {
 // WalkPackage does nothing if the package has already been loaded.
 
 func (w *Walker) WalkPackage(pkg string) {
+	if w.canceled() {
+		return
+	}
+
 	if build.IsLocalImport(pkg) {
 		wd, err := os.Getwd()
 		if err != nil {
@@ -949,6 +965,8 @@ func (w *Walker) WalkPackage(pkg string) {
 		}
 
 		w.WalkPackageDir(bp.Name, bp.Dir, bp)
+	} else if dir, ok := w.mod.Dir(pkg); ok {
+		w.WalkPackageDir(pkg, dir, nil)
 	} else {
 		bp, err := w.context.Import(pkg, "", build.FindOnly)
 		if err != nil {
@@ -1047,6 +1065,10 @@ func (w *Walker) WalkPackageDir(name string, dir string, bp *build.Package) {
 	}
 	var deps []string
 	for _, file := range files {
+		if w.canceled() {
+			return
+		}
+
 		var src interface{} = nil
 		if w.cursorInfo != nil &&
 			w.cursorInfo.pkg == name &&
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	// goEnvKeys are the variables reported by `go env` that are passed to methods
+	goEnvKeys = []string{
+		"GOROOT",
+		"GOPATH",
+		"GOMODCACHE",
+		"GOFLAGS",
+		"GOOS",
+		"GOARCH",
+		"CGO_ENABLED",
+		"GOVERSION",
+	}
+
+	// goEnvKeyVars are the variables that change what `go env` reports, the cache is keyed on their values.
+	// HOME and GOENV select the go env file, which may set the others
+	goEnvKeyVars = []string{
+		"GOROOT",
+		"PATH",
+		"GOFLAGS",
+		"GOOS",
+		"GOARCH",
+		"CGO_ENABLED",
+		"GOPATH",
+		"GOMODCACHE",
+		"GOTOOLCHAIN",
+		"GOENV",
+		"HOME",
+	}
+
+	goEnvCache = struct {
+		lck sync.Mutex
+		m   map[string]map[string]string
+	}{m: map[string]map[string]string{}}
+)
+
+func init() {
+	cacheDropper("go env", func() {
+		goEnvCache.lck.Lock()
+		defer goEnvCache.lck.Unlock()
+		goEnvCache.m = map[string]map[string]string{}
+	})
+}
+
+// goEnv returns the values of goEnvKeys as reported by `go env` when it's run in env,
+// which overrides environ. The result is cached per toolchain and the values of goEnvKeyVars.
+// If the go tool cannot be run, the values are taken from env and defaultEnv instead, they're not cached
+// so it's tried again next time
+func goEnv(cx *Ctx, env map[string]string) map[string]string {
+	merged := environ()
+	for k, v := range env {
+		merged[k] = v
+	}
+
+	tool := goTool(merged)
+	key := goEnvKey(tool, merged)
+
+	goEnvCache.lck.Lock()
+	res, ok := goEnvCache.m[key]
+	goEnvCache.lck.Unlock()
+	if ok {
+		return copyEnv(res)
+	}
+
+	res = map[string]string{}
+	buf := bytes.NewBuffer(nil)
+	errBuf := bytes.NewBuffer(nil)
+	c := exec.Command(tool, append([]string{"env", "-json"}, goEnvKeys...)...)
+	c.Env = envSlice(merged)
+	// so that the go.mod of wherever margo was started doesn't select a different toolchain
+	c.Dir = os.TempDir()
+	c.Stdout = buf
+	c.Stderr = errBuf
+	err := execCmd(cx, c)
+	if err == nil {
+		err = json.Unmarshal(buf.Bytes(), &res)
+	}
+	if err != nil {
+		if !cx.Canceled() {
+			Logf(LogWarn, M{"go": tool}, "Cannot run go env: %v %s", err, strings.TrimSpace(errBuf.String()))
+		}
+		return goEnvFallback(merged)
+	}
+
+	goEnvCache.lck.Lock()
+	goEnvCache.m[key] = res
+	goEnvCache.lck.Unlock()
+	return copyEnv(res)
+}
+
+// goEnvFallback returns the values of goEnvKeys found in env or defaultEnv
+func goEnvFallback(env map[string]string) map[string]string {
+	def := defaultEnv()
+	res := map[string]string{}
+	for _, k := range goEnvKeys {
+		if v := orString(env[k], def[k]); v != "" {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// goTool returns the go command of the toolchain used in env:
+// the one in GOROOT if it's set, otherwise the first one in PATH
+func goTool(env map[string]string) string {
+	exe := "go"
+	if runtime.GOOS == "windows" {
+		exe += ".exe"
+	}
+
+	if goroot := env["GOROOT"]; goroot != "" {
+		fn := filepath.Join(goroot, "bin", exe)
+		if fi, err := os.Stat(fn); err == nil && !fi.IsDir() {
+			return fn
+		}
+	}
+
+	for _, dir := range filepath.SplitList(env["PATH"]) {
+		fn := filepath.Join(dir, exe)
+		if fi, err := os.Stat(fn); err == nil && !fi.IsDir() {
+			return fn
+		}
+	}
+	return exe
+}
+
+func goEnvKey(tool string, env map[string]string) string {
+	l := make([]string, 0, len(goEnvKeyVars)+1)
+	l = append(l, tool)
+	for _, k := range goEnvKeyVars {
+		l = append(l, k+"="+env[k])
+	}
+	return strings.Join(l, "\x00")
+}
+
+func copyEnv(env map[string]string) map[string]string {
+	m := make(map[string]string, len(env))
+	for k, v := range env {
+		m[k] = v
+	}
+	return m
+}
+
+// withGoEnv adds the values of goEnvKeys that aren't set in env and returns env
+func withGoEnv(cx *Ctx, env map[string]string) map[string]string {
+	if env == nil {
+		env = map[string]string{}
+	}
+	for k, v := range goEnv(cx, env) {
+		if env[k] == "" {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// gorootSrc returns the directory of the standard library in goroot.
+// It's GOROOT/src since Go 1.4, but GOROOT/src/pkg before that
+func gorootSrc(goroot string) string {
+	if goroot == "" {
+		return ""
+	}
+
+	old := filepath.Join(goroot, "src", "pkg")
+	if fi, err := os.Stat(filepath.Join(old, "fmt")); err == nil && fi.IsDir() {
+		return old
+	}
+	return filepath.Join(goroot, "src")
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// modFile is the part of a go.mod or go.work file that's needed to resolve import paths
+type modFile struct {
+	Fn string
+	// Dir is the directory that contains the file
+	Dir     string
+	Path    string
+	Require map[string]string
+	// Replace maps `path` or `path@version` to its replacement
+	Replace map[string]modReplace
+	// Use holds the directories of the modules in a workspace
+	Use []string
+}
+
+type modReplace struct {
+	// Path is either a module path or, if Version is empty, an absolute directory
+	Path    string
+	Version string
+}
+
+// srcRoot is a directory whose sub-directories are the packages with import paths below Path
+type srcRoot struct {
+	Dir  string
+	Path string
+}
+
+// modResolver maps import paths to directories as seen from inside a module or workspace,
+// or a GOPATH package that has vendor directories
+type modResolver struct {
+	// main holds the main modules: the module that contains the file and those used by the workspace, if any
+	main []*modFile
+	// vendor holds the vendor directories that are searched before the module cache, innermost first
+	vendor []string
+	// require and replace are merged from all the main modules, the workspace's replacements take priority
+	require map[string]string
+	replace map[string]modReplace
+	goroot  string
+	cache   string
+}
+
+var (
+	modFiles = struct {
+		lck sync.Mutex
+		m   map[string]modFileEntry
+	}{m: map[string]modFileEntry{}}
+)
+
+type modFileEntry struct {
+	mtime time.Time
+	mod   *modFile
+	err   error
+}
+
+func init() {
+	cacheDropper("go.mod", func() {
+		modFiles.lck.Lock()
+		defer modFiles.lck.Unlock()
+		modFiles.m = map[string]modFileEntry{}
+	})
+}
+
+// findModFile returns the name of the go.mod file of the module that contains dir or an empty string
+func findModFile(dir string) string {
+	return findUp(dir, "go.mod")
+}
+
+// findWorkFile returns the name of the go.work file of the workspace that contains dir or an empty string.
+// Like the go command, GOWORK may name the file or be set to `off` to disable workspaces
+func findWorkFile(dir string, env map[string]string) string {
+	switch s := orString(env["GOWORK"], os.Getenv("GOWORK")); {
+	case s == "off":
+		return ""
+	case s != "":
+		if filepath.IsAbs(s) {
+			return s
+		}
+		return ""
+	}
+	return findUp(dir, "go.work")
+}
+
+// findUp returns the name of the first file called name in dir or one of its parents
+func findUp(dir string, name string) string {
+	// a relative dir would be relative to wherever margo was started, which means nothing to the client
+	if dir == "" || !filepath.IsAbs(dir) {
+		return ""
+	}
+
+	dir = filepath.Clean(dir)
+	for {
+		fn := filepath.Join(dir, name)
+		if fi, err := os.Stat(fn); err == nil && !fi.IsDir() {
+			return fn
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readModFile parses the go.mod or go.work file fn. The result is cached until the file changes
+func readModFile(fn string) (*modFile, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	modFiles.lck.Lock()
+	e, ok := modFiles.m[fn]
+	modFiles.lck.Unlock()
+	if ok && e.mtime.Equal(fi.ModTime()) {
+		return e.mod, e.err
+	}
+
+	s, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := parseModFile(fn, string(s))
+
+	modFiles.lck.Lock()
+	modFiles.m[fn] = modFileEntry{
+		mtime: fi.ModTime(),
+		mod:   mod,
+		err:   err,
+	}
+	modFiles.lck.Unlock()
+
+	return mod, err
+}
+
+func parseModFile(fn string, s string) (*modFile, error) {
+	mod := &modFile{
+		Fn:      fn,
+		Dir:     filepath.Dir(fn),
+		Require: map[string]string{},
+		Replace: map[string]modReplace{},
+	}
+
+	block := ""
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		f := modFields(line)
+		if len(f) == 0 {
+			continue
+		}
+
+		if block != "" {
+			if f[0] == ")" {
+				block = ""
+				continue
+			}
+			f = append([]string{block}, f...)
+		} else if len(f) == 2 && f[1] == "(" {
+			block = f[0]
+			continue
+		}
+
+		switch f[0] {
+		case "module":
+			if len(f) >= 2 {
+				mod.Path = f[1]
+			}
+		case "require":
+			if len(f) >= 3 {
+				mod.Require[f[1]] = f[2]
+			}
+		case "replace":
+			if err := mod.addReplace(f[1:]); err != nil {
+				return nil, err
+			}
+		case "use":
+			if len(f) >= 2 {
+				mod.Use = append(mod.Use, mod.localDir(f[1]))
+			}
+		}
+	}
+
+	if mod.Path == "" && filepath.Base(fn) == "go.mod" {
+		return nil, errors.New(fn + ": no module path")
+	}
+	return mod, nil
+}
+
+func (mod *modFile) addReplace(f []string) error {
+	i := 0
+	for i < len(f) && f[i] != "=>" {
+		i++
+	}
+	if i == 0 || i != len(f)-2 && i != len(f)-3 {
+		return errors.New(mod.Fn + ": invalid replace " + strings.Join(f, " "))
+	}
+
+	old := f[0]
+	if i == 2 {
+		old += "@" + f[1]
+	}
+
+	r := modReplace{Path: f[i+1]}
+	if i+2 < len(f) {
+		r.Version = f[i+2]
+	} else {
+		r.Path = mod.localDir(r.Path)
+	}
+	mod.Replace[old] = r
+	return nil
+}
+
+// localDir returns the directory dir, which is relative to the file if it's not absolute
+func (mod *modFile) localDir(dir string) string {
+	dir = filepath.FromSlash(dir)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(mod.Dir, dir)
+	}
+	return filepath.Clean(dir)
+}
+
+// modFields splits line into words, unquoting quoted words
+func modFields(line string) []string {
+	l := []string{}
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return l
+		}
+
+		if line[0] == '"' || line[0] == '`' {
+			end := strings.IndexByte(line[1:], line[0])
+			if end >= 0 {
+				if s, err := strconv.Unquote(line[:end+2]); err == nil {
+					l = append(l, s)
+					line = line[end+2:]
+					continue
+				}
+			}
+		}
+
+		end := strings.IndexFunc(line, unicode.IsSpace)
+		if end < 0 {
+			end = len(line)
+		}
+		l = append(l, line[:end])
+		line = line[end:]
+	}
+}
+
+// modEscape escapes upper-case letters in s as the module cache does e.g. `Azure` becomes `!azure`
+func modEscape(s string) string {
+	buf := make([]rune, 0, len(s))
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			buf = append(buf, '!', unicode.ToLower(r))
+		} else {
+			buf = append(buf, r)
+		}
+	}
+	return string(buf)
+}
+
+// modCacheDir returns the module cache directory, GOMODCACHE
+func modCacheDir(env map[string]string) string {
+	if s := orString(env["GOMODCACHE"], os.Getenv("GOMODCACHE")); s != "" {
+		return s
+	}
+
+	gopath := orString(env["GOPATH"], os.Getenv("GOPATH"))
+	if l := filepath.SplitList(gopath); len(l) > 0 && l[0] != "" {
+		return filepath.Join(l[0], "pkg", "mod")
+	}
+	if home := orString(env["HOME"], os.Getenv("HOME")); home != "" {
+		return filepath.Join(home, "go", "pkg", "mod")
+	}
+	return ""
+}
+
+// gopathDirs returns the GOPATH of env, or its default
+func gopathDirs(env map[string]string) string {
+	if gopath := orString(env["GOPATH"], os.Getenv("GOPATH")); gopath != "" {
+		return gopath
+	}
+	if home := orString(env["HOME"], os.Getenv("HOME")); home != "" {
+		return filepath.Join(home, "go")
+	}
+	return ""
+}
+
+// newModResolver returns a resolver for packages in the module or workspace that contains dir
+// or nil if dir isn't inside either and there are no vendor directories above it
+func newModResolver(dir string, env map[string]string) *modResolver {
+	r := &modResolver{
+		require: map[string]string{},
+		replace: map[string]modReplace{},
+		goroot:  orString(env["GOROOT"], os.Getenv("GOROOT"), defaultEnv()["GOROOT"]),
+		cache:   modCacheDir(env),
+	}
+
+	if fn := findModFile(dir); fn != "" {
+		r.addMain(fn)
+	}
+
+	var work *modFile
+	if fn := findWorkFile(dir, env); fn != "" {
+		mod, err := readModFile(fn)
+		if err != nil {
+			Logf(LogWarn, M{"fn": fn}, "Cannot read go.work: %v", err)
+		} else {
+			work = mod
+			for _, dir := range work.Use {
+				r.addMain(filepath.Join(dir, "go.mod"))
+			}
+		}
+	}
+
+	if len(r.main) == 0 {
+		r.vendor = findVendorDirs(dir, gopathDirs(env))
+		if len(r.vendor) == 0 {
+			return nil
+		}
+		return r
+	}
+
+	// only the vendor directory of the main module, or workspace, is used in module mode
+	root := r.main[0].Dir
+	if work != nil {
+		root = work.Dir
+	}
+	if vdir := modVendorDir(root, env); vdir != "" {
+		r.vendor = []string{vdir}
+	}
+
+	for _, mod := range r.main {
+		for p, v := range mod.Require {
+			if _, ok := r.require[p]; !ok {
+				r.require[p] = v
+			}
+		}
+		for p, repl := range mod.Replace {
+			if _, ok := r.replace[p]; !ok {
+				r.replace[p] = repl
+			}
+		}
+	}
+	if work != nil {
+		for p, repl := range work.Replace {
+			r.replace[p] = repl
+		}
+	}
+	return r
+}
+
+// addMain adds the module of the go.mod file fn to the main modules, unless it's already there
+func (r *modResolver) addMain(fn string) {
+	for _, mod := range r.main {
+		if mod.Fn == fn {
+			return
+		}
+	}
+
+	mod, err := readModFile(fn)
+	if err != nil {
+		Logf(LogWarn, M{"fn": fn}, "Cannot read go.mod: %v", err)
+		return
+	}
+	r.main = append(r.main, mod)
+}
+
+func pathHasPrefix(p, pfx string) bool {
+	return p == pfx || strings.HasPrefix(p, pfx+"/")
+}
+
+// Dir returns the directory of the package importPath
+func (r *modResolver) Dir(importPath string) (string, bool) {
+	if dir, ok := r.ModDir(importPath); ok {
+		return dir, true
+	}
+	if r == nil {
+		return "", false
+	}
+
+	// in module mode, the standard library is always found in GOROOT/src
+	first := importPath
+	if i := strings.Index(importPath, "/"); i >= 0 {
+		first = importPath[:i]
+	}
+	if r.goroot != "" && first != "" && !strings.Contains(first, ".") {
+		return r.existingDir(gorootSrc(r.goroot), importPath)
+	}
+	return "", false
+}
+
+// ModDir is like Dir, but only finds packages in the main modules, vendor directories and the modules they require
+func (r *modResolver) ModDir(importPath string) (string, bool) {
+	if r == nil || importPath == "" {
+		return "", false
+	}
+
+	// the longest module path wins e.g. `golang.org/x/tools/gopls` over `golang.org/x/tools`
+	var main *modFile
+	for _, mod := range r.main {
+		if pathHasPrefix(importPath, mod.Path) && (main == nil || len(mod.Path) > len(main.Path)) {
+			main = mod
+		}
+	}
+	if main != nil {
+		return r.existingDir(main.Dir, importPath[len(main.Path):])
+	}
+
+	for _, vdir := range r.vendor {
+		if dir, ok := r.existingDir(vdir, importPath); ok {
+			return dir, true
+		}
+	}
+
+	modPath := ""
+	for p, _ := range r.require {
+		if len(p) > len(modPath) && pathHasPrefix(importPath, p) {
+			modPath = p
+		}
+	}
+	for k, _ := range r.replace {
+		p := k
+		if i := strings.Index(p, "@"); i >= 0 {
+			p = p[:i]
+		}
+		if len(p) > len(modPath) && pathHasPrefix(importPath, p) {
+			modPath = p
+		}
+	}
+
+	if modPath != "" {
+		if dir, ok := r.moduleDir(modPath); ok {
+			return r.existingDir(dir, importPath[len(modPath):])
+		}
+	}
+	return "", false
+}
+
+// moduleDir returns the directory of the required module modPath
+func (r *modResolver) moduleDir(modPath string) (string, bool) {
+	version := r.require[modPath]
+
+	repl, ok := r.replace[modPath+"@"+version]
+	if !ok {
+		repl, ok = r.replace[modPath]
+	}
+	if ok {
+		if repl.Version == "" {
+			return repl.Path, true
+		}
+		modPath, version = repl.Path, repl.Version
+	}
+
+	if version == "" || r.cache == "" {
+		return "", false
+	}
+	return filepath.Join(r.cache, modEscape(modPath)+"@"+modEscape(version)), true
+}
+
+func (r *modResolver) existingDir(root string, rel string) (string, bool) {
+	dir := filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(rel, "/")))
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		return dir, true
+	}
+	return "", false
+}
+
+// Roots returns the directories of the main modules, the vendor directories and the modules they require
+func (r *modResolver) Roots() []srcRoot {
+	if r == nil {
+		return nil
+	}
+
+	roots := []srcRoot{}
+	for _, mod := range r.main {
+		roots = append(roots, srcRoot{Dir: mod.Dir, Path: mod.Path})
+	}
+	for _, vdir := range r.vendor {
+		// the import paths of vendored packages are relative to the vendor dir, like GOPATH/src
+		roots = append(roots, srcRoot{Dir: vdir})
+	}
+	for p, _ := range r.require {
+		if r.isMain(p) {
+			continue
+		}
+
+		if dir, ok := r.moduleDir(p); ok {
+			if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+				roots = append(roots, srcRoot{Dir: dir, Path: p})
+			}
+		}
+	}
+	return roots
+}
+
+// isMain reports whether modPath is one of the main modules
+func (r *modResolver) isMain(modPath string) bool {
+	for _, mod := range r.main {
+		if mod.Path == modPath {
+			return true
+		}
+	}
+	return false
+}
+
+// importPath joins the root's import path with the slash-separated path rel
+func (sr srcRoot) importPath(rel string) string {
+	return path.Join(sr.Path, rel)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"time"
+)
+
+var (
+	// maxResponseSize is the size, in bytes, of the largest result a method may return.
+	// larger results are replaced by an error, they would likely stall the client anyway.
+	maxResponseSize = 64 << 20
+
+	// goEnvMethods are the methods that analyse packages and so need the values reported by `go env`.
+	// methods that run commands e.g. `sh` are given the Env exactly as the client sent it
+	goEnvMethods = map[string]bool{
+		"doc":             true,
+		"doc2":            true,
+		"declarations":    true,
+		"lint":            true,
+		"gocode_complete": true,
+		"gocode_calltip":  true,
+		"imports":         true,
+		"import_paths":    true,
+		"pkgpaths":        true,
+		"pkg_dirs":        true,
+	}
+)
+
+// Validator is implemented by callers that can reject their arguments before they're called
+type Validator interface {
+	Validate() string
+}
+
+// Auditor is implemented by callers that run commands, it returns what's logged about the call.
+// It mustn't include e.g. file contents or the values of environment variables, they may hold secrets
+type Auditor interface {
+	Audit() M
+}
+
+// timeCall records the duration and outcome of every call for `stats`.
+// Calls the broker gave up on e.g. because they timed out are recorded by the broker instead
+func timeCall(inv *Invocation, next CallFunc) (interface{}, string) {
+	start := time.Now()
+	res, err := next()
+	if inv.Cx.record() {
+		recordCall(inv.Req.Method, time.Now().Sub(start), err, inv.Panic != nil)
+	}
+	return res, err
+}
+
+// recoverCall turns a panic in the method into an error
+func recoverCall(inv *Invocation, next CallFunc) (res interface{}, err string) {
+	defer func() {
+		if v := recover(); v != nil {
+			buf := make([]byte, 64*1024*1024)
+			n := runtime.Stack(buf, true)
+			inv.Panic = v
+			inv.B.logf(inv.Req, LogError, M{"stack": string(buf[:n])}, "PANIC: %v", v)
+			res = M{}
+			err = "broker: " + inv.Req.Method + "#" + inv.Req.Token + " PANIC"
+		}
+	}()
+	return next()
+}
+
+// auditCall logs the arguments and outcome of methods that run commands
+func auditCall(inv *Invocation, next CallFunc) (interface{}, string) {
+	if registry.Class(inv.Req.Method) != Spawning {
+		return next()
+	}
+
+	// the arguments aren't logged as-is, logs are sent to clients
+	fields := M{}
+	if a, ok := inv.Cl.(Auditor); ok {
+		fields = a.Audit()
+	}
+	inv.B.logf(inv.Req, LogInfo, fields, "audit: calling %s", inv.Req.Method)
+
+	start := time.Now()
+	res, err := next()
+
+	fields = M{"dur": time.Now().Sub(start).String()}
+	if err != "" {
+		fields["error"] = err
+	}
+	inv.B.logf(inv.Req, LogInfo, fields, "audit: called %s", inv.Req.Method)
+	return res, err
+}
+
+// validateCall rejects calls whose arguments fail validation
+func validateCall(inv *Invocation, next CallFunc) (interface{}, string) {
+	if v, ok := inv.Cl.(Validator); ok {
+		if err := v.Validate(); err != "" {
+			return M{}, err
+		}
+	}
+	return next()
+}
+
+// defaultCallEnv fills the `Env` of goEnvMethods with environ if the client didn't send one
+// and adds the values reported by `go env` that it doesn't set
+func defaultCallEnv(inv *Invocation, next CallFunc) (interface{}, string) {
+	if !goEnvMethods[inv.Req.Method] {
+		return next()
+	}
+
+	v := reflect.ValueOf(inv.Cl)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	if v.Kind() == reflect.Struct {
+		f := v.FieldByName("Env")
+		if f.IsValid() && f.CanSet() && f.Type() == reflect.TypeOf(map[string]string{}) {
+			env := f.Interface().(map[string]string)
+			inv.Cx.setClientEnv(env)
+			if len(env) == 0 {
+				env = environ()
+			} else {
+				env = copyEnv(env)
+			}
+			f.Set(reflect.ValueOf(withGoEnv(inv.Cx, env)))
+		}
+	}
+	return next()
+}
+
+func init() {
+	registry.Use(
+		timeCall,
+		recoverCall,
+		auditCall,
+		validateCall,
+		defaultCallEnv,
+	)
+}
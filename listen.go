@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// listenAddr splits addr into the network and address to listen on.
+// addr is either `unix:path`, `tcp:host:port` or, without a prefix, a path if it contains a slash
+// and a tcp address otherwise
+func listenAddr(addr string) (network string, address string) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", addr[len("unix:"):]
+	case strings.HasPrefix(addr, "tcp:"):
+		return "tcp", addr[len("tcp:"):]
+	case strings.ContainsAny(addr, `/\`):
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// serve accepts connections on addr until margo is interrupted.
+// each connection gets its own broker, everything else e.g. the caches and registry are shared
+func serve(addr string, tag string, secret string, wait bool) error {
+	network, address := listenAddr(addr)
+	switch network {
+	case "unix":
+		if err := removeStaleSocket(address); err != nil {
+			return err
+		}
+	case "tcp":
+		if secret == "" {
+			// anyone that can connect would be able to run commands
+			return errors.New("listening on a tcp address requires -secret")
+		}
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			// the listener was closed
+			return nil
+		}
+
+		go func() {
+			defer conn.Close()
+
+			b := NewBroker(conn, conn, tag)
+			b.secret = secret
+			b.Loop(true, wait)
+		}()
+	}
+}
+
+// removeStaleSocket removes the unix socket at path if nothing is listening on it,
+// e.g. because a previous instance died without cleaning up. Anything else at path is left alone
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New(path + " exists and is not a socket")
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return errors.New(path + " is in use by another process")
+	}
+	return os.Remove(path)
+}
+
+// authorized returns true if the connection doesn't require authentication or has already
+// been authenticated. Otherwise line must be a `hello` request carrying the shared secret as `secret`.
+// It's checked before the request is decoded by its method so nothing else is read from unauthorized clients
+func (b *Broker) authorized(req *Request, line []byte) bool {
+	if b.secret == "" || b.authed {
+		return true
+	}
+	if req.Method != "hello" {
+		return false
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(line))
+	args := M{}
+	if dec.Decode(&Request{}) != nil || dec.Decode(&args) != nil {
+		return false
+	}
+	s, _ := args["secret"].(string)
+	if subtle.ConstantTimeCompare([]byte(s), []byte(b.secret)) == 1 {
+		b.authed = true
+		return true
+	}
+	return false
+}
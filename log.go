@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+	// LogOff is the level of a client that doesn't want any log entries
+	LogOff
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (l LogLevel) String() string {
+	if l >= 0 && int(l) < len(logLevelNames) {
+		return logLevelNames[l]
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+func parseLogLevel(s string) (LogLevel, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range logLevelNames {
+		if s == name {
+			return LogLevel(i), true
+		}
+	}
+	return LogOff, false
+}
+
+// LogEntry is a single structured log event. Token and Method identify the request,
+// if any, during which the event occurred.
+type LogEntry struct {
+	Level   LogLevel
+	Message string
+	Token   string
+	Method  string
+	Fields  M
+	Time    time.Time
+}
+
+func (e LogEntry) data() M {
+	m := M{
+		"level":   e.Level.String(),
+		"message": e.Message,
+		"time":    e.Time.Format(time.RFC3339Nano),
+	}
+	if e.Token != "" {
+		m["token"] = e.Token
+	}
+	if e.Method != "" {
+		m["method"] = e.Method
+	}
+	if len(e.Fields) != 0 {
+		m["fields"] = e.Fields
+	}
+	return m
+}
+
+func (e LogEntry) String() string {
+	s := e.Level.String() + " "
+	if e.Method != "" || e.Token != "" {
+		s += e.Method + "#" + e.Token + " "
+	}
+	s += e.Message
+
+	keys := make([]string, 0, len(e.Fields))
+	for k, _ := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// multi-line values e.g. stack traces are written after everything else
+	tail := ""
+	for _, k := range keys {
+		v := fmt.Sprint(e.Fields[k])
+		if strings.Contains(v, "\n") {
+			tail += "\n" + v
+		} else {
+			s += fmt.Sprintf(" %s=%q", k, v)
+		}
+	}
+	return s + tail
+}
+
+// logEntry writes e to stderr and forwards it, as a `margo.log` response,
+// to the clients of brokers whose level is at or below e's level.
+// If b is nil, e is forwarded to the clients of all brokers.
+func logEntry(b *Broker, e LogEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	// depth 3 is the caller of the log function that called us
+	logger.Output(3, e.String())
+
+	resp := Response{
+		Token: "margo.log",
+		Data:  e.data(),
+	}
+
+	if b != nil {
+		b.forwardLog(e.Level, resp)
+		return
+	}
+
+	brokersLck.Lock()
+	l := make([]*Broker, 0, len(brokers))
+	for b, _ := range brokers {
+		l = append(l, b)
+	}
+	brokersLck.Unlock()
+
+	for _, b := range l {
+		b.forwardLog(e.Level, resp)
+	}
+}
+
+// Logf logs a message that isn't tied to any client or request
+func Logf(level LogLevel, fields M, format string, a ...interface{}) {
+	logEntry(nil, LogEntry{
+		Level:   level,
+		Message: fmt.Sprintf(format, a...),
+		Fields:  fields,
+	})
+}
+
+// Logf logs a message on behalf of the request cx
+func (cx *Ctx) Logf(level LogLevel, fields M, format string, a ...interface{}) {
+	e := LogEntry{
+		Level:   level,
+		Message: fmt.Sprintf(format, a...),
+		Fields:  fields,
+	}
+
+	var b *Broker
+	if cx != nil {
+		b = cx.b
+		e.Token = cx.Token
+		e.Method = cx.Method
+	}
+	logEntry(b, e)
+}
+
+// logf logs a message on behalf of the request req, if any, of b's client
+func (b *Broker) logf(req *Request, level LogLevel, fields M, format string, a ...interface{}) {
+	e := LogEntry{
+		Level:   level,
+		Message: fmt.Sprintf(format, a...),
+		Fields:  fields,
+	}
+	if req != nil {
+		e.Token = req.Token
+		e.Method = req.Method
+	}
+	logEntry(b, e)
+}
+
+func (b *Broker) forwardLog(level LogLevel, resp Response) {
+	b.logLck.Lock()
+	min := b.logLevel
+	b.logLck.Unlock()
+
+	if level >= min {
+		// SendNoLog because a failure would be logged, and forwarded, again
+		b.SendNoLog(resp)
+	}
+}
+
+// setLogLevel sets the minimum level of log entries forwarded to b's client and returns the previous level
+func (b *Broker) setLogLevel(level LogLevel) LogLevel {
+	b.logLck.Lock()
+	defer b.logLck.Unlock()
+
+	prev := b.logLevel
+	b.logLevel = level
+	return prev
+}
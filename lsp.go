@@ -0,0 +1,775 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// lspServer speaks the Language Server Protocol, it's another transport for the methods in the registry.
+// Requests are translated into calls of the corresponding method e.g. `textDocument/completion`
+// is a `gocode_complete` call and the results are translated back.
+type lspServer struct {
+	b    *Broker
+	in   *bufio.Reader
+	w    io.Writer
+	wLck sync.Mutex
+	docs map[string]*lspDoc
+	dLck sync.Mutex
+	ids  counter
+}
+
+type lspDoc struct {
+	uri     string
+	fn      string
+	src     string
+	version int
+}
+
+type lspMessage struct {
+	ID     *json.RawMessage `json:"id,omitempty"`
+	Method string           `json:"method,omitempty"`
+	Params json.RawMessage  `json:"params,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+const (
+	lspParseError     = -32700
+	lspMethodNotFound = -32601
+	lspInternalError  = -32603
+	lspCancelled      = -32800
+)
+
+func newLspServer(r io.Reader, w io.Writer) *lspServer {
+	return &lspServer{
+		// the broker is only used by methods to send messages, the LSP client wouldn't understand them
+		b:    NewBroker(strings.NewReader(""), ioutil.Discard, ""),
+		in:   bufio.NewReader(r),
+		w:    w,
+		docs: map[string]*lspDoc{},
+	}
+}
+
+// Loop reads and handles messages until the client sends `exit` or closes the connection
+func (l *lspServer) Loop() {
+	l.b.startPools(&sync.WaitGroup{})
+	defer l.b.stopPools()
+
+	tp := textproto.NewReader(l.in)
+	for {
+		hdr, err := tp.ReadMIMEHeader()
+		if err != nil {
+			if err != io.EOF {
+				Logf(LogError, nil, "lsp: Cannot read header: %v", err)
+			}
+			return
+		}
+
+		n, err := strconv.Atoi(hdr.Get("Content-Length"))
+		if err != nil || n < 0 {
+			Logf(LogError, nil, "lsp: Invalid Content-Length `%s`", hdr.Get("Content-Length"))
+			return
+		}
+
+		body := make([]byte, n)
+		if _, err := io.ReadFull(l.in, body); err != nil {
+			Logf(LogError, nil, "lsp: Cannot read body: %v", err)
+			return
+		}
+
+		msg := lspMessage{}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			l.reply(nil, nil, &lspError{Code: lspParseError, Message: err.Error()})
+			continue
+		}
+
+		if msg.Method == "exit" {
+			return
+		}
+
+		// requests are answered asynchronously, but notifications like didChange must be handled in order
+		if msg.ID == nil {
+			l.notified(msg)
+		} else {
+			go l.requested(msg)
+		}
+	}
+}
+
+func (l *lspServer) write(v interface{}) {
+	s, err := json.Marshal(v)
+	if err != nil {
+		Logf(LogError, nil, "lsp: Cannot encode message: %v", err)
+		return
+	}
+
+	l.wLck.Lock()
+	defer l.wLck.Unlock()
+
+	fmt.Fprintf(l.w, "Content-Length: %d\r\n\r\n", len(s))
+	l.w.Write(s)
+}
+
+func (l *lspServer) reply(id *json.RawMessage, result interface{}, e *lspError) {
+	m := M{
+		"jsonrpc": "2.0",
+		"id":      id,
+	}
+	if e != nil {
+		m["error"] = e
+	} else {
+		m["result"] = result
+	}
+	l.write(m)
+}
+
+func (l *lspServer) notify(method string, params interface{}) {
+	l.write(M{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+}
+
+// call calls the registered method name as if args were sent as its request by a broker client.
+// token identifies the call so that it can be canceled with `$/cancelRequest`.
+// res is the result of the method round-tripped through json into v.
+func (l *lspServer) call(token string, name string, args M, v interface{}) string {
+	return l.callReq(&Request{Method: name, Token: token}, args, v)
+}
+
+// callReq is like call, but the request header e.g. Coalesce is set by the caller
+func (l *lspServer) callReq(req *Request, args M, v interface{}) string {
+	name := req.Method
+	m := registry.Lookup(name)
+	if m == nil {
+		return "Invalid method " + name
+	}
+
+	cl := m(l.b)
+	s, err := json.Marshal(args)
+	if err == nil {
+		err = json.Unmarshal(s, cl)
+	}
+	if err != nil {
+		return err.Error()
+	}
+
+	// the call is queued like those of other clients, so it's subject to the same limits and deadlines
+	resCh := make(chan Response, 1)
+	e := l.b.enqueue(Job{
+		Req: req,
+		Cl:  cl,
+		Cx:  newCtx(l.b, req),
+		Reply: func(resp Response) {
+			resCh <- resp
+		},
+	})
+	if e != "" {
+		return e
+	}
+
+	resp := <-resCh
+	if resp.Error != "" {
+		return resp.Error
+	}
+
+	s, err = json.Marshal(resp.Data)
+	if err != nil {
+		return err.Error()
+	}
+	if e := responseTooLarge(len(s)); e != "" {
+		return e
+	}
+	return errStr(json.Unmarshal(s, v))
+}
+
+func (l *lspServer) requested(msg lspMessage) {
+	token := "lsp." + string(*msg.ID)
+	res, e := l.handle(token, msg)
+	if e == "" {
+		l.reply(msg.ID, res, nil)
+		return
+	}
+
+	code := lspInternalError
+	switch {
+	case e == "canceled":
+		code = lspCancelled
+	case strings.HasPrefix(e, "Invalid method"):
+		code = lspMethodNotFound
+	}
+	l.reply(msg.ID, nil, &lspError{Code: code, Message: e})
+}
+
+func (l *lspServer) handle(token string, msg lspMessage) (interface{}, string) {
+	switch msg.Method {
+	case "initialize":
+		return M{
+			"capabilities": M{
+				// full sync
+				"textDocumentSync": 1,
+				"completionProvider": M{
+					"triggerCharacters": []string{"."},
+				},
+				"signatureHelpProvider": M{
+					"triggerCharacters": []string{"(", ","},
+				},
+				"definitionProvider":              true,
+				"documentFormattingProvider":      true,
+				"documentRangeFormattingProvider": true,
+				"documentSymbolProvider":          true,
+			},
+			"serverInfo": M{
+				"name": "margo",
+			},
+		}, ""
+	case "shutdown":
+		return nil, ""
+	case "textDocument/completion":
+		return l.completion(token, msg.Params)
+	case "textDocument/signatureHelp":
+		return l.signatureHelp(token, msg.Params)
+	case "textDocument/definition":
+		return l.definition(token, msg.Params)
+	case "textDocument/formatting", "textDocument/rangeFormatting":
+		return l.formatting(token, msg.Params)
+	case "textDocument/documentSymbol":
+		return l.documentSymbol(token, msg.Params)
+	}
+	return nil, "Invalid method " + msg.Method
+}
+
+func (l *lspServer) notified(msg lspMessage) {
+	switch msg.Method {
+	case "$/cancelRequest":
+		p := struct {
+			ID json.RawMessage `json:"id"`
+		}{}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			l.b.cancel("lsp." + string(p.ID))
+		}
+	case "textDocument/didOpen":
+		p := struct {
+			TextDocument struct {
+				URI     string `json:"uri"`
+				Text    string `json:"text"`
+				Version int    `json:"version"`
+			} `json:"textDocument"`
+		}{}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			td := p.TextDocument
+			l.setDoc(td.URI, td.Text, td.Version)
+		}
+	case "textDocument/didChange":
+		p := struct {
+			TextDocument struct {
+				URI     string `json:"uri"`
+				Version int    `json:"version"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}{}
+		if json.Unmarshal(msg.Params, &p) == nil && len(p.ContentChanges) > 0 {
+			td := p.TextDocument
+			l.setDoc(td.URI, p.ContentChanges[len(p.ContentChanges)-1].Text, td.Version)
+		}
+	case "textDocument/didSave":
+		p := lspTextDocumentPosition{}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			if d := l.doc(p.TextDocument.URI); d != nil {
+				go l.publishDiagnostics(d)
+			}
+		}
+	case "textDocument/didClose":
+		p := lspTextDocumentPosition{}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			uri := p.TextDocument.URI
+			l.dLck.Lock()
+			delete(l.docs, uri)
+			l.dLck.Unlock()
+
+			l.notify("textDocument/publishDiagnostics", M{
+				"uri":         uri,
+				"diagnostics": []M{},
+			})
+		}
+	}
+}
+
+func (l *lspServer) setDoc(uri, src string, version int) {
+	d := &lspDoc{
+		uri:     uri,
+		fn:      lspUriFn(uri),
+		src:     src,
+		version: version,
+	}
+
+	l.dLck.Lock()
+	l.docs[uri] = d
+	l.dLck.Unlock()
+
+	go l.publishDiagnostics(d)
+}
+
+// doc returns the open document uri or, if it's not open, the file it refers to
+func (l *lspServer) doc(uri string) *lspDoc {
+	l.dLck.Lock()
+	d := l.docs[uri]
+	l.dLck.Unlock()
+
+	if d != nil {
+		return d
+	}
+
+	fn := lspUriFn(uri)
+	s, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	return &lspDoc{
+		uri: uri,
+		fn:  fn,
+		src: string(s),
+	}
+}
+
+func (l *lspServer) docPos(params json.RawMessage) (*lspDoc, int, string) {
+	p := lspTextDocumentPosition{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, 0, err.Error()
+	}
+
+	d := l.doc(p.TextDocument.URI)
+	if d == nil {
+		return nil, 0, "Unknown document " + p.TextDocument.URI
+	}
+	return d, lspOffset(d.src, p.Position), ""
+}
+
+func (l *lspServer) publishDiagnostics(d *lspDoc) {
+	res := struct {
+		Reports []mLintReport
+	}{}
+	// diagnostics are published on every change so only the latest lint of each file matters
+	req := &Request{
+		Method:   "lint",
+		Token:    "lsp.lint." + l.ids.nextString(),
+		Coalesce: "lint:" + d.fn,
+	}
+	e := l.callReq(req, M{
+		"Fn":  d.fn,
+		"Src": d.src,
+		"Dir": filepath.Dir(d.fn),
+	}, &res)
+	if e != "" {
+		if e != "superseded" {
+			Logf(LogWarn, M{"fn": d.fn}, "lsp: lint: %s", e)
+		}
+		return
+	}
+
+	// a newer version will publish its own diagnostics
+	l.dLck.Lock()
+	cur := l.docs[d.uri]
+	l.dLck.Unlock()
+	if cur != d {
+		return
+	}
+
+	diags := []M{}
+	for _, r := range res.Reports {
+		if r.Fn != d.fn {
+			continue
+		}
+
+		severity := 2
+		if r.Kind == "gs.syntax" {
+			severity = 1
+		}
+		pos := lspRowColPos(d.src, r.Row, r.Col)
+		diags = append(diags, M{
+			"range": lspRange{
+				Start: pos,
+				End:   pos,
+			},
+			"severity": severity,
+			"code":     r.Kind,
+			"source":   "margo",
+			"message":  r.Message,
+		})
+	}
+
+	l.notify("textDocument/publishDiagnostics", M{
+		"uri":         d.uri,
+		"version":     d.version,
+		"diagnostics": diags,
+	})
+}
+
+func (l *lspServer) completion(token string, params json.RawMessage) (interface{}, string) {
+	d, offset, e := l.docPos(params)
+	if e != "" {
+		return nil, e
+	}
+
+	res := struct {
+		Completions []struct {
+			Name  string
+			Type  string
+			Class string
+		}
+	}{}
+	e = l.call(token, "gocode_complete", M{
+		"Fn":  d.fn,
+		"Src": d.src,
+		"Pos": utf8.RuneCountInString(d.src[:offset]),
+	}, &res)
+	if e != "" {
+		return nil, e
+	}
+
+	kinds := map[string]int{
+		"func":    3,
+		"var":     6,
+		"type":    7,
+		"package": 9,
+		"const":   21,
+	}
+	items := []M{}
+	for _, c := range res.Completions {
+		items = append(items, M{
+			"label":  c.Name,
+			"detail": c.Type,
+			"kind":   kinds[c.Class],
+		})
+	}
+	return items, ""
+}
+
+func (l *lspServer) signatureHelp(token string, params json.RawMessage) (interface{}, string) {
+	d, offset, e := l.docPos(params)
+	if e != "" {
+		return nil, e
+	}
+
+	res := struct {
+		Calltips []struct {
+			Name string
+			Type string
+		}
+	}{}
+	e = l.call(token, "gocode_calltip", M{
+		"Fn":  d.fn,
+		"Src": d.src,
+		"Pos": utf8.RuneCountInString(d.src[:offset]),
+	}, &res)
+	if e != "" || len(res.Calltips) == 0 {
+		return nil, e
+	}
+
+	c := res.Calltips[0]
+	return M{
+		"signatures": []M{
+			{"label": c.Name + strings.TrimPrefix(c.Type, "func")},
+		},
+	}, ""
+}
+
+func (l *lspServer) definition(token string, params json.RawMessage) (interface{}, string) {
+	d, offset, e := l.docPos(params)
+	if e != "" {
+		return nil, e
+	}
+
+	args := M{
+		"Fn":     d.fn,
+		"Src":    d.src,
+		"Offset": offset,
+	}
+	docs := []Doc{}
+	e = l.call(token, "doc2", args, &docs)
+	if e == "" && len(docs) == 0 {
+		e = l.call(token, "doc", args, &docs)
+	}
+	if e != "" {
+		return nil, e
+	}
+
+	locs := []lspLocation{}
+	for _, doc := range docs {
+		if doc.Fn == "" {
+			continue
+		}
+
+		pos := lspPosition{
+			Line:      doc.Row,
+			Character: doc.Col,
+		}
+		if dd := l.doc(lspFnUri(doc.Fn)); dd != nil {
+			pos = lspRowColPos(dd.src, doc.Row, doc.Col)
+		}
+		locs = append(locs, lspLocation{
+			URI: lspFnUri(doc.Fn),
+			Range: lspRange{
+				Start: pos,
+				End:   pos,
+			},
+		})
+	}
+	return locs, ""
+}
+
+// formatting formats the whole document or, if the params have a range, the lines it touches
+func (l *lspServer) formatting(token string, params json.RawMessage) (interface{}, string) {
+	p := struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+		Range   *lspRange `json:"range"`
+		Options struct {
+			TabSize      int  `json:"tabSize"`
+			InsertSpaces bool `json:"insertSpaces"`
+		} `json:"options"`
+	}{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err.Error()
+	}
+
+	d := l.doc(p.TextDocument.URI)
+	if d == nil {
+		return nil, "Unknown document " + p.TextDocument.URI
+	}
+
+	args := M{
+		"Fn":        d.fn,
+		"Src":       d.src,
+		"TabIndent": !p.Options.InsertSpaces,
+	}
+	if p.Options.TabSize > 0 {
+		args["TabWidth"] = p.Options.TabSize
+	}
+	if p.Range != nil {
+		end := lspOffset(d.src, p.Range.End)
+		// fmt formats the whole file if End is 0, but the range is empty
+		if end == 0 {
+			return []M{}, ""
+		}
+		args["Start"] = lspOffset(d.src, p.Range.Start)
+		args["End"] = end
+	}
+	res := struct {
+		Src  string
+		Edit *struct {
+			Start int
+			End   int
+			Text  string
+		}
+	}{}
+	if e := l.call(token, "fmt", args, &res); e != "" {
+		return nil, e
+	}
+
+	if res.Src == d.src {
+		return []M{}, ""
+	}
+	if e := res.Edit; e != nil {
+		return []M{
+			{
+				"range": lspRange{
+					Start: lspPos(d.src, e.Start),
+					End:   lspPos(d.src, e.End),
+				},
+				"newText": e.Text,
+			},
+		}, ""
+	}
+	return []M{
+		{
+			"range": lspRange{
+				End: lspPos(d.src, len(d.src)),
+			},
+			"newText": res.Src,
+		},
+	}, ""
+}
+
+func (l *lspServer) documentSymbol(token string, params json.RawMessage) (interface{}, string) {
+	p := lspTextDocumentPosition{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, err.Error()
+	}
+
+	d := l.doc(p.TextDocument.URI)
+	if d == nil {
+		return nil, "Unknown document " + p.TextDocument.URI
+	}
+
+	res := struct {
+		FileDecls []mDeclarationsDecl `json:"file_decls"`
+	}{}
+	e := l.call(token, "declarations", M{
+		"Fn":  d.fn,
+		"Src": d.src,
+	}, &res)
+	if e != "" {
+		return nil, e
+	}
+
+	kinds := map[string]int{
+		"type":  5,
+		"func":  12,
+		"var":   13,
+		"const": 14,
+	}
+	syms := []M{}
+	for _, decl := range res.FileDecls {
+		kind := kinds[decl.Kind]
+		name := decl.Name
+		if decl.Repr != "" {
+			// methods
+			kind = 6
+			name = decl.Repr
+		}
+
+		pos := lspRowColPos(d.src, decl.Row, decl.Col)
+		syms = append(syms, M{
+			"name": name,
+			"kind": kind,
+			"location": lspLocation{
+				URI: d.uri,
+				Range: lspRange{
+					Start: pos,
+					End:   pos,
+				},
+			},
+		})
+	}
+	return syms, ""
+}
+
+func lspUriFn(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+
+	fn := u.Path
+	// file:///C:/dir/file.go
+	if runtime.GOOS == "windows" && len(fn) > 2 && fn[0] == '/' && fn[2] == ':' {
+		fn = fn[1:]
+	}
+	return filepath.FromSlash(fn)
+}
+
+func lspFnUri(fn string) string {
+	fn = filepath.ToSlash(fn)
+	if !strings.HasPrefix(fn, "/") {
+		fn = "/" + fn
+	}
+	u := url.URL{
+		Scheme: "file",
+		Path:   fn,
+	}
+	return u.String()
+}
+
+// lspOffset converts the line and UTF-16 based character of pos into a byte offset in src
+func lspOffset(src string, pos lspPosition) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		i := strings.IndexByte(src[offset:], '\n')
+		if i < 0 {
+			return len(src)
+		}
+		offset += i + 1
+	}
+
+	for n := 0; n < pos.Character && offset < len(src); {
+		r, size := utf8.DecodeRuneInString(src[offset:])
+		if r == '\n' {
+			break
+		}
+		n += len(utf16.Encode([]rune{r}))
+		offset += size
+	}
+	return offset
+}
+
+// lspPos converts the byte offset in src into a line and UTF-16 based character
+func lspPos(src string, offset int) lspPosition {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(src) {
+		offset = len(src)
+	}
+
+	pos := lspPosition{}
+	s := src[:offset]
+	if i := strings.LastIndex(s, "\n"); i >= 0 {
+		pos.Line = strings.Count(s, "\n")
+		s = s[i+1:]
+	}
+	pos.Character = len(utf16.Encode([]rune(s)))
+	return pos
+}
+
+// lspRowColPos converts the zero-based row and byte column used by the methods into an LSP position
+func lspRowColPos(src string, row, col int) lspPosition {
+	// e.g. the position of an error that isn't in any particular place
+	if col < 0 {
+		col = 0
+	}
+	offset := 0
+	for i := 0; i < row; i++ {
+		j := strings.IndexByte(src[offset:], '\n')
+		if j < 0 {
+			return lspPos(src, len(src))
+		}
+		offset += j + 1
+	}
+
+	if eol := strings.IndexByte(src[offset:], '\n'); eol >= 0 && col > eol {
+		col = eol
+	}
+	return lspPos(src, offset+col)
+}
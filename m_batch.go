@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type mBatchStep struct {
+	Method string          `json:"method"`
+	Args   json.RawMessage `json:"args"`
+}
+
+type mBatchResult struct {
+	Method string      `json:"method"`
+	Error  string      `json:"error"`
+	Data   interface{} `json:"data"`
+}
+
+type mBatch struct {
+	Steps     []mBatchStep `json:"steps"`
+	ThreadSrc bool         `json:"thread_src"`
+	b         *Broker
+}
+
+// Call calls each step in order. If ThreadSrc is set, the `src` result of a step
+// replaces the `Src` argument of the steps that follow it
+func (m *mBatch) Call(cx *Ctx) (interface{}, string) {
+	results := []mBatchResult{}
+	src := ""
+	threading := false
+
+	for _, step := range m.Steps {
+		if cx.Canceled() {
+			return M{}, cx.Err()
+		}
+
+		r := mBatchResult{
+			Method: step.Method,
+			Data:   M{},
+		}
+
+		args, err := m.args(step, src, threading)
+		if err != nil {
+			r.Error = err.Error()
+			results = append(results, r)
+			continue
+		}
+
+		method := registry.Lookup(step.Method)
+		if method == nil || step.Method == "batch" {
+			r.Error = "Invalid method " + step.Method
+			results = append(results, r)
+			continue
+		}
+
+		// steps are called on the batch's worker, so methods that need a pool of their own aren't allowed
+		if class := registry.Class(step.Method); class != Interactive {
+			r.Error = "broker: " + class.String() + " methods cannot be called in a batch"
+			results = append(results, r)
+			continue
+		}
+
+		cl := method(m.b)
+		s, _ := json.Marshal(args)
+		if err := json.Unmarshal(s, cl); err != nil {
+			r.Error = err.Error()
+			results = append(results, r)
+			continue
+		}
+
+		scx, stop := cx.child(step.Method)
+		resp := m.b.exec(&Request{Method: step.Method, Token: cx.Token}, cl, scx)
+		stop()
+		r.Error = resp.Error
+		r.Data = resp.Data
+		if e := scx.Err(); e != "" {
+			r.Error = e
+		}
+		results = append(results, r)
+
+		if m.ThreadSrc && r.Error == "" {
+			inSrc, _ := argSrc(args)
+			if s, ok := batchSrc(inSrc, r.Data); ok {
+				src = s
+				threading = true
+			}
+		}
+	}
+
+	res := M{
+		"results": results,
+	}
+	if threading {
+		res["src"] = src
+	}
+	return res, ""
+}
+
+// args decodes the arguments of step, replacing its Src with src if threading is true
+func (m *mBatch) args(step mBatchStep, src string, threading bool) (M, error) {
+	args := M{}
+	if len(step.Args) > 0 {
+		if err := json.Unmarshal(step.Args, &args); err != nil {
+			return nil, err
+		}
+	}
+
+	if threading {
+		// args are matched case-insensitively so remove any `src` to avoid ambiguity
+		for k, _ := range args {
+			if strings.EqualFold(k, "src") {
+				delete(args, k)
+			}
+		}
+		args["Src"] = src
+	}
+	return args, nil
+}
+
+func argSrc(args M) (string, bool) {
+	for k, v := range args {
+		if strings.EqualFold(k, "src") {
+			s, ok := v.(string)
+			return s, ok
+		}
+	}
+	return "", false
+}
+
+// batchSrc returns the full source resulting from a step whose input was inSrc
+func batchSrc(inSrc string, data interface{}) (string, bool) {
+	res, _ := data.(M)
+	src, ok := res["src"].(string)
+	if !ok || src == "" {
+		return "", false
+	}
+
+	// `imports` only returns the source up to lineRef, the client is expected to patch the rest
+	if lineRef, ok := res["lineRef"].(int); ok {
+		lines := strings.SplitAfter(inSrc, "\n")
+		if lineRef < len(lines) {
+			src += strings.Join(lines[lineRef:], "")
+		}
+	}
+	return src, true
+}
+
+func init() {
+	registry.Register("batch", func(b *Broker) Caller {
+		return &mBatch{b: b}
+	})
+}
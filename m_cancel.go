@@ -0,0 +1,19 @@
+package main
+
+type mCancel struct {
+	Token string
+	b     *Broker
+}
+
+func (m *mCancel) Call(_ *Ctx) (res interface{}, err string) {
+	res = M{
+		m.Token: m.b.cancel(m.Token),
+	}
+	return
+}
+
+func init() {
+	registry.Register("cancel", func(b *Broker) Caller {
+		return &mCancel{b: b}
+	})
+}
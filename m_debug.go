@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+const (
+	// debugProfileMaxSeconds limits the duration of cpu profiles, a forgotten profile slows down everything else
+	debugProfileMaxSeconds = 300
+	// debugSummaryLines is the number of frames in the summary of a profile
+	debugSummaryLines = 20
+)
+
+type mDebugProfile struct {
+	Seconds int
+}
+
+type mDebugHeap struct{}
+
+type mDebugGoroutines struct{}
+
+func (m *mDebugProfile) Call(cx *Ctx) (interface{}, string) {
+	if m.Seconds <= 0 || m.Seconds > debugProfileMaxSeconds {
+		return M{}, fmt.Sprintf("Seconds must be between 1 and %d", debugProfileMaxSeconds)
+	}
+
+	f, err := debugProfileFile("cpu")
+	if err != nil {
+		return M{}, err.Error()
+	}
+	defer f.Close()
+
+	if err := pprof.StartCPUProfile(f); err != nil {
+		return M{}, err.Error()
+	}
+
+	start := time.Now()
+	select {
+	case <-time.After(time.Duration(m.Seconds) * time.Second):
+	case <-cx.Done():
+	}
+	pprof.StopCPUProfile()
+	dur := time.Now().Sub(start)
+
+	res := debugProfileResult(cx, f.Name())
+	res["dur"] = dur.String()
+	return res, ""
+}
+
+func (m *mDebugHeap) Call(cx *Ctx) (interface{}, string) {
+	return debugLookup(cx, "heap")
+}
+
+func (m *mDebugGoroutines) Call(cx *Ctx) (interface{}, string) {
+	return debugLookup(cx, "goroutine")
+}
+
+// debugLookup writes the profile `name` e.g. `heap` and returns its result
+func debugLookup(cx *Ctx, name string) (M, string) {
+	f, err := debugProfileFile(name)
+	if err != nil {
+		return M{}, err.Error()
+	}
+	defer f.Close()
+
+	if name == "heap" {
+		// make sure the profile reflects what's actually in use
+		runtime.GC()
+	}
+
+	if err := pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		return M{}, err.Error()
+	}
+	return debugProfileResult(cx, f.Name()), ""
+}
+
+func debugProfileFile(name string) (*os.File, error) {
+	fn := filepath.Join(
+		tempDir(nil, "debug"),
+		fmt.Sprintf("%s-%s.pprof", name, time.Now().Format("20060102-150405.000")),
+	)
+	return os.Create(fn)
+}
+
+// debugProfileResult returns the file name of the profile fn and a summary of its top frames
+func debugProfileResult(cx *Ctx, fn string) M {
+	res := M{
+		"fn": fn,
+	}
+
+	buf := bytes.NewBuffer(nil)
+	c := exec.Command("go", "tool", "pprof", "-top", fmt.Sprintf("-nodecount=%d", debugSummaryLines), fn)
+	c.Env = envSlice(environ())
+	c.Stdout = buf
+	c.Stderr = buf
+	if err := execCmd(cx, c); err != nil {
+		// the profile is still useful, it just needs to be looked at elsewhere
+		res["summary_error"] = strings.TrimSpace(err.Error() + "\n" + buf.String())
+	} else {
+		res["summary"] = buf.String()
+	}
+	return res
+}
+
+func init() {
+	registry.RegisterClass("debug_profile", Background, func(_ *Broker) Caller {
+		return &mDebugProfile{
+			Seconds: 10,
+		}
+	})
+
+	registry.RegisterClass("debug_heap", Background, func(_ *Broker) Caller {
+		return &mDebugHeap{}
+	})
+
+	registry.RegisterClass("debug_goroutines", Background, func(_ *Broker) Caller {
+		return &mDebugGoroutines{}
+	})
+}
@@ -7,13 +7,15 @@ import (
 	"go/printer"
 	"go/token"
 	"os"
+	"path/filepath"
 )
 
 type mDeclarations struct {
-	Fn     string
-	Src    string
-	PkgDir string
-	Env    map[string]string
+	Fn           string
+	Src          string
+	PkgDir       string
+	Env          map[string]string
+	BuildOptions BuildOptions
 }
 
 type mDeclarationsDecl struct {
@@ -25,7 +27,7 @@ type mDeclarationsDecl struct {
 	Col  int    `json:"col"`
 }
 
-func (m *mDeclarations) Call() (interface{}, string) {
+func (m *mDeclarations) Call(_ *Ctx) (interface{}, string) {
 	fileDecls := []*mDeclarationsDecl{}
 	pkgDecls := []*mDeclarationsDecl{}
 
@@ -37,10 +39,12 @@ func (m *mDeclarations) Call() (interface{}, string) {
 	if m.PkgDir != "" {
 		var pkgs map[string]*ast.Package
 
+		bf := newBuildFilter(m.Env, m.BuildOptions)
 		if fi, err := os.Stat(m.PkgDir); err == nil && fi.IsDir() {
-			_, pkgs, _ = parsePkg(fset, m.PkgDir, 0)
+			_, pkgs, _ = parsePkg(fset, m.PkgDir, bf, 0)
 		} else {
-			_, pkgs, _ = findPkg(fset, m.PkgDir, rootDirs(m.Env), 0)
+			mr := newModResolver(filepath.Dir(m.Fn), m.Env)
+			_, pkgs, _ = findPkg(fset, m.PkgDir, mr, rootDirs(m.Env), bf, 0)
 		}
 
 		for _, pkg := range pkgs {
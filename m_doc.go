@@ -6,7 +6,6 @@ import (
 	"go/token"
 	"path"
 	"path/filepath"
-	"runtime"
 	"sort"
 	"strings"
 )
@@ -22,15 +21,16 @@ type Doc struct {
 }
 
 type mDoc struct {
-	Fn        string
-	Src       string
-	Env       map[string]string
-	Offset    int
-	TabIndent bool
-	TabWidth  int
+	Fn           string
+	Src          string
+	Env          map[string]string
+	BuildOptions BuildOptions
+	Offset       int
+	TabIndent    bool
+	TabWidth     int
 }
 
-func (m *mDoc) Call() (interface{}, string) {
+func (m *mDoc) Call(cx *Ctx) (interface{}, string) {
 	res := []*Doc{}
 
 	fset, af, err := parseAstFile(m.Fn, m.Src, parser.ParseComments)
@@ -38,12 +38,17 @@ func (m *mDoc) Call() (interface{}, string) {
 		return res, err.Error()
 	}
 
-	sel, id := identAt(fset, af, m.Offset)
+	sel, id := identAt(fset, af, cx.byteOffset(m.Src, m.Offset, "utf-8"))
 	if id == nil {
 		return res, ""
 	}
 
-	pkgs, _ := parser.ParseDir(fset, filepath.Dir(m.Fn), fiHasGoExt, parser.ParseComments)
+	// the file itself is always used, but only the files of its package that would be built are used with it
+	bf := newBuildFilter(m.Env, m.BuildOptions)
+	_, pkgs, _ := parsePkg(fset, filepath.Dir(m.Fn), bf, parser.ParseComments)
+	if cx.Canceled() {
+		return res, cx.Err()
+	}
 	if pkgs == nil {
 		pkgs = map[string]*ast.Package{}
 	}
@@ -61,7 +66,8 @@ func (m *mDoc) Call() (interface{}, string) {
 	}
 	pkgs[pkg.Name] = pkg
 
-	obj, pkg, objPkgs := findUnderlyingObj(fset, af, pkg, pkgs, rootDirs(m.Env), sel, id)
+	mr := newModResolver(filepath.Dir(m.Fn), m.Env)
+	obj, pkg, objPkgs := findUnderlyingObj(fset, af, pkg, pkgs, mr, rootDirs(m.Env), bf, sel, id)
 	if obj != nil {
 		res = append(res, objDoc(fset, pkg, m.TabIndent, m.TabWidth, obj))
 		if objPkgs != nil {
@@ -170,7 +176,7 @@ func identAt(fset *token.FileSet, af *ast.File, offset int) (sel *ast.SelectorEx
 	return
 }
 
-func findUnderlyingObj(fset *token.FileSet, af *ast.File, pkg *ast.Package, pkgs map[string]*ast.Package, srcRootDirs []string, sel *ast.SelectorExpr, id *ast.Ident) (*ast.Object, *ast.Package, map[string]*ast.Package) {
+func findUnderlyingObj(fset *token.FileSet, af *ast.File, pkg *ast.Package, pkgs map[string]*ast.Package, mr *modResolver, srcRootDirs []string, bf *buildFilter, sel *ast.SelectorExpr, id *ast.Ident) (*ast.Object, *ast.Package, map[string]*ast.Package) {
 	if id != nil && id.Obj != nil {
 		return id.Obj, pkg, pkgs
 	}
@@ -184,8 +190,8 @@ func findUnderlyingObj(fset *token.FileSet, af *ast.File, pkg *ast.Package, pkgs
 		if obj := pkg.Scope.Lookup(id.Name); obj != nil {
 			return obj, pkg, pkgs
 		}
-		fn := filepath.Join(runtime.GOROOT(), "src", "pkg", "builtin")
-		if pkgBuiltin, _, err := parsePkg(fset, fn, parser.ParseComments); err == nil {
+		// builtin.go refers to names it doesn't declare, so errors are expected
+		if pkgBuiltin, _, _ := findPkg(fset, "builtin", mr, srcRootDirs, nil, parser.ParseComments); pkgBuiltin != nil {
 			if obj := pkgBuiltin.Scope.Lookup(id.Name); obj != nil {
 				return obj, pkgBuiltin, pkgs
 			}
@@ -217,7 +223,7 @@ func findUnderlyingObj(fset *token.FileSet, af *ast.File, pkg *ast.Package, pkgs
 					if pkgAlias == x.Name {
 						if id == x {
 							// where do we go as the first place of a package?
-							pkg, pkgs, _ = findPkg(fset, importPath, srcRootDirs, parser.ParseComments|parser.PackageClauseOnly)
+							pkg, pkgs, _ = findPkg(fset, importPath, mr, srcRootDirs, bf, parser.ParseComments|parser.PackageClauseOnly)
 							if pkg != nil {
 								// we'll just match the behaviour of package browsing
 								// we will visit some file within the package
@@ -269,7 +275,7 @@ func findUnderlyingObj(fset *token.FileSet, af *ast.File, pkg *ast.Package, pkgs
 							return nil, pkg, pkgs
 						}
 
-						if pkg, pkgs, _ = findPkg(fset, importPath, srcRootDirs, parser.ParseComments); pkg != nil {
+						if pkg, pkgs, _ = findPkg(fset, importPath, mr, srcRootDirs, bf, parser.ParseComments); pkg != nil {
 							obj := pkg.Scope.Lookup(id.Name)
 							return obj, pkg, pkgs
 						}
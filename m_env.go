@@ -3,7 +3,6 @@ package main
 import (
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 )
 
@@ -17,6 +16,9 @@ type mEnv struct {
 }
 
 func mEnvGetEnv(k string) string {
+	if v := configEnv()[k]; v != "" {
+		return v
+	}
 	v := os.Getenv(k)
 	if v == "" {
 		v = mEnvVars[k]
@@ -24,29 +26,24 @@ func mEnvGetEnv(k string) string {
 	return v
 }
 
-func (m *mEnv) Call() (interface{}, string) {
+func (m *mEnv) Call(cx *Ctx) (interface{}, string) {
 	env := map[string]string{}
 	addLibPath := false
+	genv := goEnv(cx, nil)
 
 	if len(m.List) == 0 {
 		addLibPath = true
 
-		for k, v := range mEnvVars {
+		env = processEnv()
+		for k, v := range genv {
 			env[k] = v
 		}
-
-		for _, s := range os.Environ() {
-			p := strings.SplitN(s, "=", 2)
-			if len(p) == 2 {
-				env[p[0]] = p[1]
-			} else {
-				env[p[0]] = ""
-			}
-		}
 	} else {
 		for _, k := range m.List {
 			if k == "GOSUBLIME_LIBPATH" {
 				addLibPath = true
+			} else if v, ok := genv[k]; ok {
+				env[k] = v
 			} else {
 				env[k] = mEnvGetEnv(k)
 			}
@@ -56,10 +53,10 @@ func (m *mEnv) Call() (interface{}, string) {
 	if addLibPath {
 		p := []string{}
 		sep := string(os.PathListSeparator)
-		osArch := runtime.GOOS + "_" + runtime.GOARCH
+		osArch := genv["GOOS"] + "_" + genv["GOARCH"]
 		gpath := m.Gopath
 		if gpath == "" {
-			gpath = mEnvGetEnv("GOPATH")
+			gpath = orString(genv["GOPATH"], mEnvGetEnv("GOPATH"))
 		}
 		for _, s := range strings.Split(gpath, sep) {
 			p = append(p, filepath.Join(s, "pkg", osArch))
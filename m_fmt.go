@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"go/ast"
 	"go/parser"
+	"go/scanner"
+	"go/token"
+	"strings"
 )
 
 type mFmt struct {
@@ -10,10 +15,40 @@ type mFmt struct {
 	Src       string
 	TabIndent bool
 	TabWidth  int
+	// Start and End select the part of Src that's formatted, if End is set
+	Start int
+	End   int
 }
 
-func (m *mFmt) Call() (interface{}, string) {
+func (m *mFmt) Call(cx *Ctx) (interface{}, string) {
 	res := M{}
+	if m.End > 0 {
+		// offsets aren't converted, or clamped, without Src
+		if m.Src == "" {
+			return res, "Start and End need Src"
+		}
+
+		start := cx.byteOffset(m.Src, m.Start, "utf-8")
+		end := cx.byteOffset(m.Src, m.End, "utf-8")
+		if start > end {
+			return res, "Start is after End"
+		}
+
+		start, end = fmtLines(m.Src, start, end)
+		text, err := fmtRange(m.Fn, m.Src[start:end], m.TabIndent, m.TabWidth)
+		if err != nil {
+			return res, err.Error()
+		}
+
+		res["src"] = m.Src[:start] + text + m.Src[end:]
+		res["edit"] = M{
+			"start": cx.clientOffset(m.Src, start, "utf-8"),
+			"end":   cx.clientOffset(m.Src, end, "utf-8"),
+			"text":  text,
+		}
+		return res, ""
+	}
+
 	fset, af, err := parseAstFile(m.Fn, m.Src, parser.ParseComments)
 	if err == nil {
 		ast.SortImports(fset, af)
@@ -22,6 +57,128 @@ func (m *mFmt) Call() (interface{}, string) {
 	return res, errStr(err)
 }
 
+// fmtLines extends the range start:end of src to the start and end of the lines it touches
+func fmtLines(src string, start, end int) (int, int) {
+	start = strings.LastIndex(src[:start], "\n") + 1
+	if end > start && src[end-1] == '\n' {
+		return start, end
+	}
+	if i := strings.Index(src[end:], "\n"); i >= 0 {
+		return start, end + i + 1
+	}
+	return start, len(src)
+}
+
+// fmtRange formats src, a part of the file fn, like go/format does with partial sources: as a whole file,
+// a list of declarations or a list of statements. The rest of the file isn't parsed, so it may contain errors.
+// The whitespace around src and the indentation of its first line are kept
+func fmtRange(fn, src string, tabIndent bool, tabWidth int) (string, error) {
+	i, j := 0, 0
+	for j < len(src) && isSpace(src[j]) {
+		if src[j] == '\n' {
+			i = j + 1
+		}
+		j++
+	}
+	k := len(src)
+	for k > j && isSpace(src[k-1]) {
+		k--
+	}
+	if j == k {
+		return src, nil
+	}
+
+	fset := token.NewFileSet()
+	af, header, indentAdj, err := fmtParse(fset, fn, src[j:k])
+	if err != nil {
+		if el, ok := err.(scanner.ErrorList); ok && len(el) > 0 {
+			err = el[0]
+		}
+		return "", errors.New("Cannot format the selection, it's not a list of declarations or statements: " + err.Error())
+	}
+
+	indentUnit := "\t"
+	if !tabIndent {
+		indentUnit = strings.Repeat(" ", tabWidth)
+	}
+	indent := fmtIndent(src[i:j], tabWidth)
+
+	// like go/format, the printer's indentation may be negative to undo that of the wrapping func
+	p := newPrinter(tabIndent, tabWidth)
+	p.Indent = indent + indentAdj
+	buf := &bytes.Buffer{}
+	if err := p.Fprint(buf, fset, af); err != nil {
+		return "", err
+	}
+
+	// drop the wrapping, the printer indented each of its lines too
+	out := buf.String()
+	if header != "" {
+		lines := len(strings.Split(strings.Replace(header, "\n\n", "\n", -1), "\n"))
+		n := p.Indent
+		if n < 0 {
+			n = 0
+		}
+		out = out[lines*n*len(indentUnit)+len(header):]
+		if indentAdj < 0 {
+			out = strings.TrimSuffix(strings.TrimRightFunc(out, isSpaceRune), "}")
+		}
+	}
+	out = strings.TrimSpace(out)
+
+	return src[:i] + strings.Repeat(indentUnit, indent) + out + src[k:], nil
+}
+
+// fmtParse parses src as a file, a list of declarations or a list of statements. header is the part
+// of the printed file before src, and indentAdj is how much deeper than src's own lines the printer indents them
+func fmtParse(fset *token.FileSet, fn, src string) (af *ast.File, header string, indentAdj int, err error) {
+	const mode = parser.ParseComments
+	if af, err = parser.ParseFile(fset, fn, src, mode); err == nil {
+		ast.SortImports(fset, af)
+		return af, "", 0, nil
+	}
+	// src starts with a package clause, so it's a broken file
+	if !strings.Contains(err.Error(), "expected 'package'") {
+		return nil, "", 0, err
+	}
+
+	if af, err = parser.ParseFile(fset, fn, "package p;"+src, mode); err == nil {
+		ast.SortImports(fset, af)
+		return af, "package p\n", 0, nil
+	}
+	// src starts with a declaration, so it's a broken list of declarations
+	if !strings.Contains(err.Error(), "expected declaration") {
+		return nil, "", 0, err
+	}
+
+	if af, err = parser.ParseFile(fset, fn, "package p; func _() {"+src+"\n}", mode); err == nil {
+		return af, "package p\n\nfunc _() {", -1, nil
+	}
+	return nil, "", 0, err
+}
+
+// fmtIndent returns the number of levels of indentation in ws. Spaces only count if there are no tabs
+func fmtIndent(ws string, tabWidth int) int {
+	if n := strings.Count(ws, "\t"); n > 0 {
+		return n
+	}
+	if n := strings.Count(ws, " "); n > 0 && tabWidth > 0 {
+		if n = n / tabWidth; n > 0 {
+			return n
+		}
+		return 1
+	}
+	return 0
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isSpaceRune(r rune) bool {
+	return r < 0x80 && isSpace(byte(r))
+}
+
 func init() {
 	registry.Register("fmt", func(b *Broker) Caller {
 		return &mFmt{
@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
 
@@ -21,7 +20,7 @@ const (
 var (
 	mGocodeVars = struct {
 		lck          sync.Mutex
-		lastGopath   string
+		lastLibpath  string
 		lastBuiltins string
 	}{}
 )
@@ -30,15 +29,16 @@ type mGocodeOptions struct {
 }
 
 type mGocodeComplete struct {
-	Autoinst bool
-	Env      map[string]string
-	Home     string
-	Dir      string
-	Builtins bool
-	Fn       string
-	Src      string
-	Pos      int
-	calltip  bool
+	Autoinst     bool
+	Env          map[string]string
+	BuildOptions BuildOptions
+	Home         string
+	Dir          string
+	Builtins     bool
+	Fn           string
+	Src          string
+	Pos          int
+	calltip      bool
 }
 
 type calltipVisitor struct {
@@ -61,13 +61,13 @@ func (v *calltipVisitor) Visit(node ast.Node) (w ast.Visitor) {
 	return v
 }
 
-func (m *mGocodeOptions) Call() (interface{}, string) {
+func (m *mGocodeOptions) Call(_ *Ctx) (interface{}, string) {
 	res := M{}
 	res["options"] = gocode.GoSublimeGocodeOptions()
 	return res, ""
 }
 
-func (m *mGocodeComplete) Call() (interface{}, string) {
+func (m *mGocodeComplete) Call(cx *Ctx) (interface{}, string) {
 	e := ""
 	res := M{}
 
@@ -81,14 +81,8 @@ func (m *mGocodeComplete) Call() (interface{}, string) {
 		return res, "No source"
 	}
 
-	pos := 0
-	for i, _ := range m.Src {
-		pos += 1
-		if pos > m.Pos {
-			pos = i
-			break
-		}
-	}
+	// Pos is the number of runes before the cursor unless the client negotiated another encoding
+	pos := cx.byteOffset(m.Src, m.Pos, "utf-32")
 
 	src := []byte(m.Src)
 	fn := m.Fn
@@ -99,6 +93,11 @@ func (m *mGocodeComplete) Call() (interface{}, string) {
 	mGocodeVars.lck.Lock()
 	defer mGocodeVars.lck.Unlock()
 
+	// other completions may have held the lock for a while
+	if cx.Canceled() {
+		return res, cx.Err()
+	}
+
 	builtins := "false"
 	if m.Builtins {
 		builtins = "true"
@@ -107,16 +106,23 @@ func (m *mGocodeComplete) Call() (interface{}, string) {
 		gocode.GoSublimeGocodeSet("propose-builtins", builtins)
 	}
 
+	// packages are imported from those compiled for the target platform, and only the files it builds are completed with
+	bf := newBuildFilter(m.Env, m.BuildOptions)
+	gocode.GoSublimeGocodeSetFileFilter(bf.MatchFile)
+
 	gopath := orString(m.Env["GOPATH"], os.Getenv("GOPATH"))
-	if gopath != mGocodeVars.lastGopath {
-		p := []string{}
-		osArch := runtime.GOOS + "_" + runtime.GOARCH
-		for _, s := range filepath.SplitList(gopath) {
-			p = append(p, filepath.Join(s, "pkg", osArch))
-		}
-		libpath := strings.Join(p, string(filepath.ListSeparator))
+	gocode.GoSublimeGocodeSetPlatform(gopath, bf.OSArch())
+	p := []string{}
+	for _, s := range filepath.SplitList(gopath) {
+		p = append(p, filepath.Join(s, "pkg", bf.OSArch()))
+	}
+	if goroot := m.Env["GOROOT"]; goroot != "" {
+		p = append(p, filepath.Join(goroot, "pkg", bf.OSArch()))
+	}
+	libpath := strings.Join(p, string(filepath.ListSeparator))
+	if libpath != mGocodeVars.lastLibpath {
 		gocode.GoSublimeGocodeSet("lib-path", libpath)
-		mGocodeVars.lastGopath = gopath
+		mGocodeVars.lastLibpath = libpath
 	}
 
 	if m.calltip {
@@ -128,7 +134,7 @@ func (m *mGocodeComplete) Call() (interface{}, string) {
 		if m.Autoinst && len(l) == 0 {
 			autoInstall(AutoInstOptions{
 				Src: m.Src,
-				Env: m.Env,
+				Env: cx.clientEnv(),
 			})
 		}
 	}
@@ -187,6 +193,12 @@ func offsetLine(fset *token.FileSet, af *ast.File, offset int) (line int) {
 }
 
 func init() {
+	cacheDropper("gocode", func() {
+		mGocodeVars.lck.Lock()
+		defer mGocodeVars.lck.Unlock()
+		gocode.GoSublimeGocodeDropCache()
+	})
+
 	registry.Register("gocode_options", func(b *Broker) Caller {
 		return &mGocodeOptions{}
 	})
@@ -1,11 +1,170 @@
 package main
 
+import (
+	"runtime"
+	"runtime/debug"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	// protocolVersion is increased whenever a change to the protocol might break existing clients
+	protocolVersion = 2
+)
+
+var (
+	// buildVersion may be set at build time with -ldflags "-X main.buildVersion=..."
+	buildVersion = ""
+
+	// features are the optional parts of the protocol supported by this build
+	features = M{
+		"streaming":    true,
+		"cancellation": true,
+		"deadlines":    true,
+		"batch":        true,
+		"log":          true,
+		"capabilities": true,
+	}
+
+	posEncodings = []string{"utf-8", "utf-16", "utf-32"}
+)
+
+// Caps are the optional behaviours a client enabled for its connection in its `hello`
+type Caps struct {
+	// Stream makes streaming the default for methods that support it e.g. `sh`
+	Stream bool
+	// PosEnc is the unit of positions passed to methods e.g. the `Pos` of `gocode_complete`:
+	// `utf-8` for bytes, `utf-16` for code units or `utf-32` for runes.
+	// If it's empty, each method uses its historical unit.
+	PosEnc string
+}
+
 type mHello M
 
-func (m mHello) Call() (interface{}, string) {
+func (m mHello) Call(_ *Ctx) (interface{}, string) {
 	return m, ""
 }
 
+func version() string {
+	if buildVersion != "" {
+		return buildVersion
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "(devel)"
+}
+
+// helloData returns the data of the `margo.hello` frame sent when the broker starts
+func (b *Broker) helloData() M {
+	return M{
+		"time":     b.start.String(),
+		"protocol": protocolVersion,
+		"version":  version(),
+		"go":       runtime.Version(),
+		"methods":  registry.Names(),
+		"features": features,
+		"capabilities": M{
+			"stream":            []bool{false, true},
+			"position_encoding": posEncodings,
+		},
+	}
+}
+
+// negotiate enables the capabilities declared in the `capabilities` of the client's `hello`.
+// The capabilities are replaced by those that were actually enabled so the client
+// can tell which of its requests were honoured.
+func (b *Broker) negotiate(h mHello) {
+	if h == nil {
+		return
+	}
+
+	declared, ok := h["capabilities"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	caps := Caps{}
+	enabled := M{}
+
+	if v, ok := declared["stream"].(bool); ok {
+		caps.Stream = v
+		enabled["stream"] = v
+	}
+
+	if v, ok := declared["position_encoding"].(string); ok {
+		for _, s := range posEncodings {
+			if v == s {
+				caps.PosEnc = s
+				enabled["position_encoding"] = s
+			}
+		}
+	}
+
+	b.capsLck.Lock()
+	b.caps = caps
+	b.capsLck.Unlock()
+	h["capabilities"] = enabled
+	h["protocol"] = protocolVersion
+}
+
+// byteOffset converts pos, a position in src encoded as negotiated by the client,
+// to a byte offset. def is the encoding used if the client didn't choose one.
+func (cx *Ctx) byteOffset(src string, pos int, def string) int {
+	enc := def
+	if cx != nil && cx.Caps.PosEnc != "" {
+		enc = cx.Caps.PosEnc
+	}
+
+	// the method will read the file itself, there's nothing to convert
+	if src == "" {
+		return pos
+	}
+
+	if pos <= 0 {
+		return 0
+	}
+	if enc == "utf-8" || enc == "" {
+		if pos > len(src) {
+			return len(src)
+		}
+		return pos
+	}
+
+	n := 0
+	for i, r := range src {
+		if n >= pos {
+			return i
+		}
+		if enc == "utf-16" {
+			n += len(utf16.Encode([]rune{r}))
+		} else {
+			n += 1
+		}
+	}
+	return len(src)
+}
+
+// clientOffset converts offset, a byte offset in src, to a position encoded as negotiated by the client.
+// It's the inverse of byteOffset
+func (cx *Ctx) clientOffset(src string, offset int, def string) int {
+	enc := def
+	if cx != nil && cx.Caps.PosEnc != "" {
+		enc = cx.Caps.PosEnc
+	}
+
+	if offset > len(src) {
+		offset = len(src)
+	}
+	switch enc {
+	case "utf-16":
+		return len(utf16.Encode([]rune(src[:offset])))
+	case "utf-32":
+		return utf8.RuneCountInString(src[:offset])
+	}
+	return offset
+}
+
 func init() {
 	registry.Register("hello", func(_ *Broker) Caller {
 		return &mHello{}
@@ -21,7 +21,7 @@ type mImportPathsDecl struct {
 	Path string `json:"path"`
 }
 
-func (m *mImportPaths) Call() (interface{}, string) {
+func (m *mImportPaths) Call(_ *Ctx) (interface{}, string) {
 	imports := []mImportPathsDecl{}
 	_, af, err := parseAstFile(m.Fn, m.Src, parser.ImportsOnly)
 	if err != nil {
@@ -47,7 +47,7 @@ func (m *mImportPaths) Call() (interface{}, string) {
 	}
 
 	paths := map[string]string{}
-	l, _ := importPaths(m.Env)
+	l, _ := importPaths(m.Env, filepath.Dir(m.Fn))
 	for _, p := range l {
 		paths[p] = ""
 	}
@@ -60,14 +60,16 @@ func (m *mImportPaths) Call() (interface{}, string) {
 }
 
 func init() {
-	registry.Register("import_paths", func(_ *Broker) Caller {
+	registry.RegisterClass("import_paths", Background, func(_ *Broker) Caller {
 		return &mImportPaths{
 			Env: map[string]string{},
 		}
 	})
 }
 
-func importPaths(environ map[string]string) ([]string, error) {
+// importPaths returns the import paths of the installed packages
+// and, if dir is inside a module, the packages of the module and its dependencies
+func importPaths(environ map[string]string, dir string) ([]string, error) {
 	imports := []string{
 		"unsafe",
 	}
@@ -112,5 +114,18 @@ func importPaths(environ map[string]string) ([]string, error) {
 		}
 		filepath.Walk(root, walkF)
 	}
+
+	// packages in modules aren't installed so their sources are listed instead
+	for _, root := range newModResolver(dir, environ).Roots() {
+		m := map[string]string{}
+		walkRootDir(root.Dir, m, root.Dir)
+		for p, _ := range m {
+			p = root.importPath(p)
+			if !seen[p] {
+				seen[p] = true
+				imports = append(imports, p)
+			}
+		}
+	}
 	return imports, nil
 }
@@ -28,7 +28,7 @@ type mImports struct {
 	Autoinst  bool
 }
 
-func (m *mImports) Call() (interface{}, string) {
+func (m *mImports) Call(cx *Ctx) (interface{}, string) {
 	lineRef := 0
 	src := ""
 
@@ -61,7 +61,7 @@ func (m *mImports) Call() (interface{}, string) {
 
 	if m.Autoinst {
 		autoInstall(AutoInstOptions{
-			Env:         m.Env,
+			Env:         cx.clientEnv(),
 			ImportPaths: fileImportPaths(af),
 		})
 	}
@@ -14,7 +14,7 @@ type mKill struct {
 	Cid string
 }
 
-func (m *mKill) Call() (res interface{}, err string) {
+func (m *mKill) Call(_ *Ctx) (res interface{}, err string) {
 	res = M{
 		m.Cid: killCmd(m.Cid),
 	}
@@ -69,6 +69,25 @@ func killCmd(id string) bool {
 	return false
 }
 
+// execCmd runs c and kills it if cx is canceled before it exits
+func execCmd(cx *Ctx, c *exec.Cmd) error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-cx.Done():
+			c.Process.Kill()
+		case <-exited:
+		}
+	}()
+
+	return c.Wait()
+}
+
 func init() {
 	byeDefer(func() {
 		cmdWatchLck.Lock()
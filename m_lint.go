@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/scanner"
 	"go/token"
+	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 
 	"github.com/slene/margo/something-borrowed/types"
@@ -28,8 +35,11 @@ type mLint struct {
 		fn  string
 		src string
 	}
-	Filter []string
+	Filter       []string
+	Env          map[string]string
+	BuildOptions BuildOptions
 
+	cx      *Ctx
 	fset    *token.FileSet
 	af      *ast.File
 	reports []mLintReport
@@ -43,7 +53,8 @@ var (
 	}
 )
 
-func (m *mLint) Call() (interface{}, string) {
+func (m *mLint) Call(cx *Ctx) (interface{}, string) {
+	m.cx = cx
 	m.v.fn = m.Fn.String()
 	m.v.dir = m.Dir.String()
 	m.v.src = m.Src.String()
@@ -52,12 +63,18 @@ func (m *mLint) Call() (interface{}, string) {
 	for _, kind := range m.Filter {
 		filterKind[kind] = true
 	}
+	for _, kind := range currentConfig().LintFilter {
+		filterKind[kind] = true
+	}
 
 	var err error
 	m.reports = []mLintReport{}
 	m.fset, m.af, err = parseAstFile(m.v.fn, m.v.src, parser.DeclarationErrors)
 	if err == nil {
 		for kind, f := range mLinters {
+			if cx.Canceled() {
+				break
+			}
 			if !filterKind[kind] {
 				f(kind, m)
 			}
@@ -128,12 +145,14 @@ func mLintCheckFlagParse(kind string, m *mLint) {
 }
 
 func mLintCheckTypes(kind string, m *mLint) {
+	bf := newBuildFilter(m.Env, m.BuildOptions)
 	files := []*ast.File{m.af}
 	if m.v.dir != "" {
-		pkg, pkgs, _ := parsePkg(m.fset, m.v.dir, parser.ParseComments)
+		// the file being linted is always checked, but only the files of its package that would be built are checked with it
+		pkg, pkgs, _ := parsePkg(m.fset, m.v.dir, bf, parser.ParseComments)
 		if pkg == nil {
 			for _, p := range pkgs {
-				if f := p.Files[m.v.fn]; f != nil {
+				if f := p.Files[m.v.fn]; f != nil || p.Name == m.af.Name.Name {
 					pkg = p
 					break
 				}
@@ -151,7 +170,25 @@ func mLintCheckTypes(kind string, m *mLint) {
 		}
 	}
 
+	dir := m.v.dir
+	if dir == "" {
+		dir = filepath.Dir(m.v.fn)
+	}
+	bctx := bf.Context()
+	bctx.GOROOT = orString(m.Env["GOROOT"], bctx.GOROOT)
+	bctx.GOPATH = orString(m.Env["GOPATH"], bctx.GOPATH)
+	imp := &mLintImporter{
+		cx:      m.cx,
+		fset:    m.fset,
+		bctx:    bctx,
+		mr:      newModResolver(dir, m.Env),
+		pkgs:    map[string]mLintImport{},
+		loading: map[string]bool{},
+	}
+
 	ctx := types.Context{
+		Cancel: m.cx.Done(),
+		Import: imp.Import,
 		Error: func(err error) {
 			s := mLintErrPat.FindStringSubmatch(err.Error())
 			if len(s) == 5 {
@@ -171,3 +208,122 @@ func mLintCheckTypes(kind string, m *mLint) {
 
 	ctx.Check(m.fset, files)
 }
+
+// mLintImporter type checks the packages of the module or workspace, and the modules they require, from source.
+// Other packages, including the standard library, are imported from the compiled packages of bctx's GOOS and GOARCH
+type mLintImporter struct {
+	cx      *Ctx
+	fset    *token.FileSet
+	bctx    *build.Context
+	mr      *modResolver
+	pkgs    map[string]mLintImport
+	loading map[string]bool
+}
+
+type mLintImport struct {
+	pkg *types.Package
+	err error
+}
+
+func (imp *mLintImporter) Import(imports map[string]*types.Package, path string) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	if imp.loading[path] {
+		return nil, errors.New("import cycle through " + path)
+	}
+
+	// failures are remembered too, otherwise a broken package is checked again by each of its importers
+	li, ok := imp.pkgs[path]
+	if !ok {
+		imp.loading[path] = true
+		li.pkg, li.err = imp.load(imports, path)
+		delete(imp.loading, path)
+		imp.pkgs[path] = li
+	}
+	if li.pkg != nil {
+		imports[path] = li.pkg
+	}
+	return li.pkg, li.err
+}
+
+func (imp *mLintImporter) load(imports map[string]*types.Package, path string) (pkg *types.Package, err error) {
+	dir, ok := imp.mr.ModDir(path)
+	if !ok {
+		return imp.gcImport(imports, path)
+	}
+
+	files := imp.parseDir(dir)
+	if len(files) == 0 {
+		return nil, errors.New("no Go files in " + dir)
+	}
+
+	// the checker panics on some inputs, in imported packages that shouldn't fail the whole lint
+	defer func() {
+		if e := recover(); e != nil {
+			pkg, err = nil, fmt.Errorf("cannot check %s: %v", path, e)
+		}
+	}()
+
+	ctx := types.Context{
+		Cancel: imp.cx.Done(),
+		Import: imp.Import,
+		// errors in imported packages are reported when they're linted themselves
+		Error: func(error) {},
+	}
+	pkg, _ = ctx.Check(imp.fset, files)
+	if pkg == nil {
+		return nil, errors.New("cannot check " + path)
+	}
+	pkg.Path = path
+	pkg.Complete = true
+	return pkg, nil
+}
+
+// gcImport imports the compiled package path, built for the GOOS and GOARCH of bctx.
+// If it's not installed, types.GcImport is used, but only if that's the platform margo was built for
+// because it doesn't know about any other
+func (imp *mLintImporter) gcImport(imports map[string]*types.Package, path string) (pkg *types.Package, err error) {
+	var f *os.File
+	bp, _ := imp.bctx.Import(path, "", build.FindOnly|build.AllowBinary)
+	if bp != nil && bp.PkgObj != "" {
+		f, _ = os.Open(bp.PkgObj)
+	}
+	if f == nil {
+		if imp.bctx.GOOS != runtime.GOOS || imp.bctx.GOARCH != runtime.GOARCH {
+			return nil, fmt.Errorf("%s is not installed for %s_%s", path, imp.bctx.GOOS, imp.bctx.GOARCH)
+		}
+		return types.GcImport(imports, path)
+	}
+	defer f.Close()
+
+	buf := bufio.NewReader(f)
+	if err := types.FindGcExportData(buf); err != nil {
+		return nil, fmt.Errorf("reading export data: %s: %v", bp.PkgObj, err)
+	}
+	return types.GcImportData(imports, bp.PkgObj, path, buf)
+}
+
+// parseDir parses the files of the package in dir that would be built. Function bodies are dropped,
+// only the declarations are needed to check the packages that import it
+func (imp *mLintImporter) parseDir(dir string) []*ast.File {
+	bp, _ := imp.bctx.ImportDir(dir, 0)
+	if bp == nil {
+		return nil
+	}
+
+	files := []*ast.File{}
+	for _, name := range append(bp.GoFiles, bp.CgoFiles...) {
+		f, _ := parser.ParseFile(imp.fset, filepath.Join(dir, name), nil, 0)
+		if f == nil {
+			continue
+		}
+		for _, decl := range f.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok {
+				fd.Body = nil
+			}
+		}
+		files = append(files, f)
+	}
+	return files
+}
@@ -0,0 +1,26 @@
+package main
+
+type mLogLevel struct {
+	Level string
+	b     *Broker
+}
+
+func (m *mLogLevel) Call(_ *Ctx) (interface{}, string) {
+	level, ok := parseLogLevel(m.Level)
+	if !ok {
+		return M{}, "Invalid log level `" + m.Level + "`, expected one of debug, info, warn, error or off"
+	}
+
+	prev := m.b.setLogLevel(level)
+	res := M{
+		"level": level.String(),
+		"prev":  prev.String(),
+	}
+	return res, ""
+}
+
+func init() {
+	registry.Register("log_level", func(b *Broker) Caller {
+		return &mLogLevel{b: b}
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	timeType       = reflect.TypeOf(time.Time{})
+)
+
+type mMethods struct {
+	b *Broker
+}
+
+// Call describes the arguments of each method by reflecting over the Caller its factory returns.
+// The schema is json-schema-like: `type`, `properties`, `items`, `additionalProperties` and `default`
+func (m *mMethods) Call(_ *Ctx) (interface{}, string) {
+	methods := M{}
+	for _, name := range registry.Names() {
+		cl := registry.Lookup(name)(m.b)
+		methods[name] = M{
+			"class": registry.Class(name).String(),
+			"args":  argSchema(reflect.ValueOf(cl), map[reflect.Type]bool{}),
+		}
+	}
+
+	res := M{
+		"methods": methods,
+	}
+	return res, ""
+}
+
+// argSchema describes the type of v and, if it's a struct, uses its field values as defaults.
+// seen holds the structs currently being described so recursive types e.g. mShCmd terminate
+func argSchema(v reflect.Value, seen map[reflect.Type]bool) M {
+	t := v.Type()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		if v.IsValid() && !v.IsNil() {
+			v = v.Elem()
+		} else {
+			v = reflect.Value{}
+		}
+	}
+	if !v.IsValid() {
+		v = reflect.Zero(t)
+	}
+
+	switch {
+	case t == rawMessageType:
+		return M{}
+	case t == timeType:
+		return M{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(time.Duration(0)):
+		return M{"type": "integer"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return M{"type": "boolean"}
+	case reflect.String:
+		return M{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return M{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return M{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return M{"type": "string"}
+		}
+		return M{
+			"type":  "array",
+			"items": argSchema(reflect.Zero(t.Elem()), seen),
+		}
+	case reflect.Map:
+		return M{
+			"type":                 "object",
+			"additionalProperties": argSchema(reflect.Zero(t.Elem()), seen),
+		}
+	case reflect.Struct:
+		if seen[t] {
+			return M{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		props := M{}
+		argProps(props, v, seen)
+		return M{
+			"type":       "object",
+			"properties": props,
+		}
+	}
+	// interface{} can be anything
+	return M{}
+}
+
+// argProps adds the properties of the fields of the struct v to props. Like encoding/json does when decoding,
+// the fields of embedded structs without a json name are flattened into it, unless a field of v has the same name
+func argProps(props M, v reflect.Value, seen map[reflect.Type]bool) {
+	t := v.Type()
+	embedded := []reflect.Value{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		named := false
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if s := strings.Split(tag, ",")[0]; s != "" {
+				name = s
+				named = true
+			}
+		}
+
+		fv := v.Field(i)
+		if f.Anonymous && !named {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+				if fv.IsNil() {
+					fv = reflect.Zero(ft)
+				} else {
+					fv = fv.Elem()
+				}
+			}
+			// the exported fields of unexported embedded structs are still decoded
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, fv)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		p := argSchema(fv, seen)
+		if argDefault(fv) {
+			p["default"] = fv.Interface()
+		}
+		props[name] = p
+	}
+
+	for _, ev := range embedded {
+		if seen[ev.Type()] {
+			continue
+		}
+		seen[ev.Type()] = true
+		inner := M{}
+		argProps(inner, ev, seen)
+		delete(seen, ev.Type())
+
+		for name, p := range inner {
+			if _, ok := props[name]; !ok {
+				props[name] = p
+			}
+		}
+	}
+}
+
+// argDefault returns true if v is a value the method sets before decoding the request
+func argDefault(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Ptr, reflect.Interface, reflect.Struct:
+		return false
+	}
+	// fields promoted from unexported embedded structs can't be read
+	return v.CanInterface() && !v.IsZero()
+}
+
+func init() {
+	registry.Register("methods", func(b *Broker) Caller {
+		return &mMethods{b: b}
+	})
+}
@@ -8,9 +8,12 @@ type mPing struct {
 	Delay time.Duration `json:"delay"`
 }
 
-func (m *mPing) Call() (interface{}, string) {
+func (m *mPing) Call(cx *Ctx) (interface{}, string) {
 	start := time.Now()
-	time.Sleep(m.Delay * time.Millisecond)
+	select {
+	case <-time.After(m.Delay * time.Millisecond):
+	case <-cx.Done():
+	}
 	return M{
 		"start": start.String(),
 		"end":   time.Now().String(),
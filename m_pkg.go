@@ -9,7 +9,7 @@ type mPkg struct {
 	Src string
 }
 
-func (m *mPkg) Call() (interface{}, string) {
+func (m *mPkg) Call(_ *Ctx) (interface{}, string) {
 	res := M{}
 	_, af, err := parseAstFile(m.Fn, m.Src, parser.PackageClauseOnly)
 	if err == nil {
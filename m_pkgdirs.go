@@ -14,27 +14,45 @@ var (
 )
 
 type mPkgDirs struct {
+	// Dir is used to find the module whose packages, and those of its dependencies, are included
+	Dir string
 	Env map[string]string
 }
 
-func (m *mPkgDirs) Call() (interface{}, string) {
-	return pkgDirs(m.Env), ""
+func (m *mPkgDirs) Call(_ *Ctx) (interface{}, string) {
+	return pkgDirs(m.Dir, m.Env), ""
 }
 
 func init() {
-	registry.Register("pkg_dirs", func(_ *Broker) Caller {
+	cacheDropper("pkg_dirs", func() {
+		pkgDirsLck.Lock()
+		defer pkgDirsLck.Unlock()
+		pkgDirsCache = map[string]bool{}
+	})
+
+	registry.RegisterClass("pkg_dirs", Background, func(_ *Broker) Caller {
 		return &mPkgDirs{
 			Env: map[string]string{},
 		}
 	})
 }
 
-func pkgDirs(env map[string]string) map[string]map[string]string {
+func pkgDirs(dir string, env map[string]string) map[string]map[string]string {
 	res := map[string]map[string]string{}
 	for _, root := range rootDirs(env) {
 		res[root] = map[string]string{}
 		walkRootDir(root, res[root], root)
 	}
+
+	for _, root := range newModResolver(dir, env).Roots() {
+		m := map[string]string{}
+		walkRootDir(root.Dir, m, root.Dir)
+
+		res[root.Dir] = map[string]string{}
+		for p, fn := range m {
+			res[root.Dir][root.importPath(p)] = fn
+		}
+	}
 	return res
 }
 
@@ -54,7 +72,7 @@ func walkRootDir(root string, m map[string]string, basePath string) {
 
 	names, err := dir.Readdirnames(-1)
 	for _, name := range names {
-		if name[0] == '.' || name[0] == '_' {
+		if name[0] == '.' || name[0] == '_' || name == "vendor" {
 			continue
 		}
 
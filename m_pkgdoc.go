@@ -100,7 +100,7 @@ func mPkgdocSearch(m *mPkgdoc) (interface{}, string) {
 	return res, ""
 }
 
-func (m *mPkgdoc) Call() (interface{}, string) {
+func (m *mPkgdoc) Call(_ *Ctx) (interface{}, string) {
 	if m.Q != "" {
 		return mPkgdocSearch(m)
 	}
@@ -108,7 +108,7 @@ func (m *mPkgdoc) Call() (interface{}, string) {
 }
 
 func init() {
-	registry.Register("pkgdoc", func(b *Broker) Caller {
+	registry.RegisterClass("pkgdoc", Background, func(b *Broker) Caller {
 		return &mPkgdoc{}
 	})
 }
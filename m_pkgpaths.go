@@ -6,43 +6,50 @@ import (
 )
 
 type mPkgPaths struct {
-	Env     map[string]string
-	Exclude []string
+	// Dir is used to find the module whose packages, and those of its dependencies, are included
+	Dir          string
+	Env          map[string]string
+	BuildOptions BuildOptions
+	Exclude      []string
 }
 
-func (m *mPkgPaths) Call() (interface{}, string) {
-	return mPkgPathsRes(m.Env, m.Exclude), ""
+func (m *mPkgPaths) Call(cx *Ctx) (interface{}, string) {
+	return mPkgPathsRes(cx, m.Dir, m.Env, m.BuildOptions, m.Exclude), ""
 }
 
 func init() {
-	registry.Register("pkgpaths", func(_ *Broker) Caller {
+	registry.RegisterClass("pkgpaths", Background, func(_ *Broker) Caller {
 		return &mPkgPaths{}
 	})
 }
 
-func mPkgPathsRes(env map[string]string, exclude []string) map[string]map[string]string {
+func mPkgPathsRes(cx *Ctx, dir string, env map[string]string, bo BuildOptions, exclude []string) map[string]map[string]string {
 	lck := sync.Mutex{}
 	goroot, gopaths := envRootList(env)
+	bf := newBuildFilter(env, bo)
 	res := map[string]map[string]string{}
 
 	wg := sync.WaitGroup{}
-	proc := func(srcDir string) {
+	proc := func(root srcRoot) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
-			paths := pkgPaths(srcDir, exclude)
+			paths := pkgPaths(cx, root, bf, exclude)
 			if len(paths) > 0 {
 				lck.Lock()
-				res[srcDir] = paths
+				res[root.Dir] = paths
 				lck.Unlock()
 			}
 		}()
 	}
 
-	proc(filepath.Join(goroot, "src", "pkg"))
+	proc(srcRoot{Dir: gorootSrc(goroot)})
 	for _, p := range gopaths {
-		proc(filepath.Join(p, "src"))
+		proc(srcRoot{Dir: filepath.Join(p, "src")})
+	}
+	for _, root := range newModResolver(dir, env).Roots() {
+		proc(root)
 	}
 	wg.Wait()
 
@@ -18,11 +18,36 @@ type mPlay struct {
 	Env       map[string]string `json:"env"`
 	Cid       string            `json:"cid"`
 	BuildOnly bool              `json:"build_only"`
+	Stream    bool              `json:"stream"`
 	b         *Broker
 }
 
-// todo: send the client output as it comes
-func (m *mPlay) Call() (interface{}, string) {
+func (m *mPlay) Audit() M {
+	return M{
+		"args": m.Args,
+		"dir":  m.Dir,
+		"fn":   m.Fn,
+		"env":  envKeys(m.Env),
+	}
+}
+
+func (m *mPlay) Call(cx *Ctx) (interface{}, string) {
+	var st *Stream
+	if m.Stream {
+		st = newStream(cx)
+	}
+
+	res, e := m.play(cx, st)
+	if st != nil {
+		if res == nil {
+			res = M{}
+		}
+		res = st.Done(res)
+	}
+	return res, e
+}
+
+func (m *mPlay) play(cx *Ctx, st *Stream) (M, string) {
 	env := envSlice(m.Env)
 	dir, err := ioutil.TempDir(tempDir(m.Env), "play-")
 	if err != nil {
@@ -62,21 +87,27 @@ func (m *mPlay) Call() (interface{}, string) {
 		stdOut.Reset()
 		stdErr.Reset()
 		c := exec.Command(name, args...)
-		c.Stdout = stdOut
-		c.Stderr = stdErr
+		if st != nil {
+			c.Stdout = st.Writer("out")
+			c.Stderr = st.Writer("err")
+		} else {
+			c.Stdout = stdOut
+			c.Stderr = stdErr
+		}
 		c.Dir = m.Dir
 		c.Env = env
 
 		watchCmd(m.Cid, c)
 		defer unwatchCmd(m.Cid)
 
-		err := c.Run()
+		err := execCmd(cx, c)
 		res := M{
 			"tmpFn": tmpFn,
 			"fn":    m.Fn,
 			"out":   jData(stdOut.Bytes()),
 			"err":   jData(stdErr.Bytes()),
 			"dur":   time.Now().Sub(start).String(),
+			"exit":  exitStatus(c),
 		}
 
 		return res, err
@@ -105,10 +136,11 @@ func (m *mPlay) Call() (interface{}, string) {
 }
 
 func init() {
-	registry.Register("play", func(b *Broker) Caller {
+	registry.RegisterClass("play", Spawning, func(b *Broker) Caller {
 		return &mPlay{
-			b:   b,
-			Env: map[string]string{},
+			b:      b,
+			Env:    map[string]string{},
+			Stream: b.Caps().Stream,
 		}
 	})
 }
@@ -0,0 +1,22 @@
+package main
+
+type mReloadConfig struct{}
+
+func (m *mReloadConfig) Call(_ *Ctx) (interface{}, string) {
+	fn, c, err := reloadConfig()
+	if err != nil {
+		return M{}, err.Error()
+	}
+
+	res := M{
+		"fn":     fn,
+		"config": c,
+	}
+	return res, ""
+}
+
+func init() {
+	registry.Register("reload_config", func(_ *Broker) Caller {
+		return &mReloadConfig{}
+	})
+}
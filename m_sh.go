@@ -16,15 +16,31 @@ type mShCmd struct {
 }
 
 type mSh struct {
-	Env map[string]string
-	Cmd mShCmd
-	Cid string
-	Cwd string
+	Env    map[string]string
+	Cmd    mShCmd
+	Cid    string
+	Cwd    string
+	Stream bool
 }
 
-// todo: send the client output as it comes
-//       handle And, Or
-func (m *mSh) Call() (interface{}, string) {
+func (m *mSh) Validate() string {
+	if m.Cmd.Name == "" {
+		return "Missing command name"
+	}
+	return ""
+}
+
+func (m *mSh) Audit() M {
+	return M{
+		"cmd":  m.Cmd.Name,
+		"args": m.Cmd.Args,
+		"cwd":  m.Cwd,
+		"env":  envKeys(m.Env),
+	}
+}
+
+// todo: handle And, Or
+func (m *mSh) Call(cx *Ctx) (interface{}, string) {
 	env := envSlice(m.Env)
 
 	if m.Cid == "" {
@@ -33,12 +49,22 @@ func (m *mSh) Call() (interface{}, string) {
 		killCmd(m.Cid)
 	}
 
+	var st *Stream
+	if m.Stream {
+		st = newStream(cx)
+	}
+
 	start := time.Now()
 	stdErr := bytes.NewBuffer(nil)
 	stdOut := bytes.NewBuffer(nil)
 	c := exec.Command(m.Cmd.Name, m.Cmd.Args...)
-	c.Stdout = stdOut
-	c.Stderr = stdErr
+	if st != nil {
+		c.Stdout = st.Writer("out")
+		c.Stderr = st.Writer("err")
+	} else {
+		c.Stdout = stdOut
+		c.Stderr = stdErr
+	}
 	if m.Cmd.Input != "" {
 		c.Stdin = strings.NewReader(m.Cmd.Input)
 	}
@@ -46,19 +72,25 @@ func (m *mSh) Call() (interface{}, string) {
 	c.Env = env
 
 	watchCmd(m.Cid, c)
-	err := c.Run()
+	err := execCmd(cx, c)
 	unwatchCmd(m.Cid)
 
 	res := M{
-		"out": jData(stdOut.Bytes()),
-		"err": jData(stdErr.Bytes()),
-		"dur": time.Now().Sub(start).String(),
+		"out":  jData(stdOut.Bytes()),
+		"err":  jData(stdErr.Bytes()),
+		"dur":  time.Now().Sub(start).String(),
+		"exit": exitStatus(c),
+	}
+	if st != nil {
+		res = st.Done(res)
 	}
 	return res, errStr(err)
 }
 
 func init() {
-	registry.Register("sh", func(b *Broker) Caller {
-		return &mSh{}
+	registry.RegisterClass("sh", Spawning, func(b *Broker) Caller {
+		return &mSh{
+			Stream: b.Caps().Stream,
+		}
 	})
 }
@@ -10,7 +10,7 @@ type mShare struct {
 	Src string
 }
 
-func (m mShare) Call() (interface{}, string) {
+func (m mShare) Call(_ *Ctx) (interface{}, string) {
 	res := M{}
 
 	s := bytes.TrimSpace([]byte(m.Src))
@@ -43,7 +43,7 @@ func (m mShare) Call() (interface{}, string) {
 }
 
 func init() {
-	registry.Register("share", func(_ *Broker) Caller {
+	registry.RegisterClass("share", Background, func(_ *Broker) Caller {
 		return &mShare{}
 	})
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"time"
+)
+
+type mStats struct {
+	b *Broker
+}
+
+func (m *mStats) Call(_ *Ctx) (interface{}, string) {
+	res := M{
+		"methods":     methodsStats(),
+		"pools":       m.b.status(),
+		"utilisation": m.b.utilisation(),
+		"runtime":     runtimeStats(),
+		"served":      m.b.served.val(),
+		"uptime":      time.Now().Sub(m.b.start).String(),
+	}
+	return res, ""
+}
+
+func init() {
+	registry.Register("stats", func(b *Broker) Caller {
+		return &mStats{b: b}
+	})
+}
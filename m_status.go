@@ -0,0 +1,18 @@
+package main
+
+type mStatus struct {
+	b *Broker
+}
+
+func (m *mStatus) Call(_ *Ctx) (interface{}, string) {
+	res := M{
+		"pools": m.b.status(),
+	}
+	return res, ""
+}
+
+func init() {
+	registry.Register("status", func(b *Broker) Caller {
+		return &mStatus{b: b}
+	})
+}
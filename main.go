@@ -10,7 +10,6 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -93,7 +92,7 @@ func margo_test() {
 
 	data, _ := ioutil.ReadFile(d.Fn)
 	d.Src = string(data)
-	a, b := d.Call()
+	a, b := d.Call(nil)
 	c := a.([]*Doc)
 	if len(c) > 0 {
 		e := c[0]
@@ -111,45 +110,107 @@ func main() {
 
 	do := "-"
 	poll := 0
+	pollStats := false
 	wait := false
 	dump_env := false
 	maxMemDefault := 1000
 	maxMem := 0
+	softMem := 0
 	tag := ""
+	listen := ""
+	secret := ""
+	lsp := false
+	record := ""
+	replayFn := ""
+	pluginsFn := ""
+	configFn := ""
 	flags := flag.NewFlagSet("MarGo", flag.ExitOnError)
 	flags.BoolVar(&dump_env, "env", dump_env, "if true, dump all environment variables as a json map to stdout and exit")
 	flags.BoolVar(&wait, "wait", wait, "Whether or not to wait for outstanding requests (which may be hanging forever) when exiting")
 	flags.IntVar(&poll, "poll", poll, "If N is greater than zero, send a response every N seconds. The token will be `margo.poll`")
+	flags.BoolVar(&pollStats, "poll-stats", pollStats, "Whether or not to include a summary of the runtime stats in `margo.poll` responses")
 	flags.StringVar(&do, "do", "-", "Process the specified operations(lines) and exit. `-` means operate as normal (`-do` implies `-wait=true`)")
 	flags.StringVar(&tag, "tag", tag, "Requests will include a member `tag' with this value")
-	flags.IntVar(&maxMem, "oom", maxMemDefault, "The maximum amount of memory MarGo is allowed to use. If memory use reaches this value, MarGo dies :'(")
+	flags.IntVar(&maxMem, "oom", maxMemDefault, "The maximum amount of memory, in megabytes, MarGo is allowed to use. If memory use reaches this value even after dropping caches, MarGo dies :'(")
+	flags.IntVar(&softMem, "oom-soft", softMem, "If memory use reaches this value, MarGo drops its caches. The default is 75% of -oom")
+	flags.StringVar(&listen, "listen", listen, "Serve clients connecting to the unix socket `unix:path` or tcp address `tcp:host:port` instead of stdin/stdout")
+	flags.BoolVar(&lsp, "lsp", lsp, "Speak the Language Server Protocol over stdin/stdout instead of MarGo's own protocol")
+	flags.StringVar(&record, "record", record, "Record all requests and responses to the specified file, one json object per line")
+	flags.StringVar(&replayFn, "replay", replayFn, "Call the requests recorded by -record in the specified file, print the responses that differ and exit")
+	flags.StringVar(&configFn, "config", configFn, "Read settings from the specified json file instead of $XDG_CONFIG_HOME/margo/config.json. Flags take precedence over the config")
+	flags.StringVar(&pluginsFn, "plugins", pluginsFn, "Load external method providers from the specified json file or directory of json files")
+	flags.StringVar(&secret, "secret", secret, "If set, clients connecting to -listen must send this value as `secret` in their first request, a `hello`")
 	flags.Parse(os.Args[1:])
 
-	// 4 is arbitrary,
-	runtime.GOMAXPROCS(runtime.NumCPU() + 4)
+	flags.Visit(func(f *flag.Flag) {
+		cmdlineFlags[f.Name] = true
+	})
 
 	if maxMem <= 0 {
 		maxMem = maxMemDefault
 	}
+	setOomFlagLimits(maxMem, softMem)
+
+	config, err := loadConfig(configFn)
+	if err != nil {
+		logger.Fatalln("Cannot load config", err)
+	}
+	if !cmdlineFlags["oom"] && config.Oom > 0 {
+		maxMem = config.Oom
+	}
+	if !cmdlineFlags["oom-soft"] && config.OomSoft > 0 {
+		softMem = config.OomSoft
+	}
+	if !cmdlineFlags["poll"] && config.Poll > 0 {
+		poll = config.Poll
+	}
+	if !cmdlineFlags["tag"] && config.Tag != "" {
+		tag = config.Tag
+	}
+	if !cmdlineFlags["wait"] && config.Wait != nil {
+		wait = *config.Wait
+	}
+
+	setOomSoftLimit(softMem)
 	startOomKiller(maxMem)
 
 	if dump_env {
-		m := defaultEnv()
-		for _, s := range os.Environ() {
-			p := strings.SplitN(s, "=", 2)
-			if len(p) == 2 {
-				m[p[0]] = p[1]
-			} else {
-				m[p[0]] = ""
-			}
+		json.NewEncoder(os.Stdout).Encode(processEnv())
+		os.Exit(0)
+	}
+
+	if pluginsFn != "" {
+		if err := loadPlugins(pluginsFn); err != nil {
+			logger.Fatalln("Cannot load plugins", err)
+		}
+	}
+
+	if replayFn != "" {
+		diffs, err := replay(replayFn, tag, os.Stdout)
+		if err != nil {
+			logger.Fatalln("Cannot replay", replayFn, err)
+		}
+		if diffs > 0 {
+			os.Exit(1)
 		}
-		json.NewEncoder(os.Stdout).Encode(m)
 		os.Exit(0)
 	}
 
+	if record != "" {
+		rec, err := newRecorder(record)
+		if err != nil {
+			logger.Fatalln("Cannot record", err)
+		}
+		trafficRec = rec
+	}
+
 	var in io.Reader = os.Stdin
 	doCall := do != "-"
 	if doCall {
+		if listen != "" {
+			logger.Fatalln("-do and -listen cannot be used together")
+		}
+
 		b64 := "base64:"
 		if strings.HasPrefix(do, b64) {
 			s, _ := base64.StdEncoding.DecodeString(do[len(b64):])
@@ -159,19 +220,22 @@ func main() {
 		}
 	}
 
-	broker := NewBroker(in, os.Stdout, tag)
 	if poll > 0 {
 		pollSeconds := time.Second * time.Duration(poll)
 		pollCounter := &counter{}
 		go func() {
 			for {
 				time.Sleep(pollSeconds)
-				broker.SendNoLog(Response{
+				data := M{
+					"time": time.Now().String(),
+					"seq":  pollCounter.nextString(),
+				}
+				if pollStats {
+					data["stats"] = runtimeStats()
+				}
+				broadcast(Response{
 					Token: "margo.poll",
-					Data: M{
-						"time": time.Now().String(),
-						"seq":  pollCounter.nextString(),
-					},
+					Data:  data,
 				})
 			}
 		}()
@@ -179,11 +243,20 @@ func main() {
 
 	go func() {
 		for r := range sendCh {
-			broker.SendNoLog(r)
+			broadcast(r)
 		}
 	}()
 
-	broker.Loop(!doCall, (wait || doCall))
+	if lsp {
+		newLspServer(os.Stdin, os.Stdout).Loop()
+	} else if listen != "" {
+		if err := serve(listen, tag, secret, wait); err != nil {
+			logger.Fatalln("Cannot listen on", listen, err)
+		}
+	} else {
+		broker := NewBroker(in, os.Stdout, tag)
+		broker.Loop(!doCall, (wait || doCall))
+	}
 
 	byeLck.Lock()
 	defer byeLck.Unlock() // keep this here for the sake of code correctness
@@ -192,7 +265,7 @@ func main() {
 			defer func() {
 				err := recover()
 				if err != nil {
-					logger.Println("PANIC defer:", err)
+					Logf(LogError, nil, "PANIC defer: %v", err)
 				}
 			}()
 
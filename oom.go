@@ -3,16 +3,149 @@ package main
 import (
 	"log"
 	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
 	"time"
 )
 
+const (
+	// oomSoftPercent is the default soft limit as a percentage of the hard limit
+	oomSoftPercent = 75
+	// oomDropInterval is the minimum time between drops at the soft limit,
+	// if caches are refilled faster than that, they're doing their job
+	oomDropInterval = 30 * time.Second
+	// oomDropTimeout is how long the watchdog waits for the caches to be dropped. A cache may be locked
+	// by a call that's hung or using up the memory, the hard limit must still be enforced in that case
+	oomDropTimeout = 5 * time.Second
+)
+
+var (
+	oomLimit = struct {
+		lck  sync.Mutex
+		mb   int
+		soft int
+		// flagMb and flagSoft are the limits set by the flags, or their defaults,
+		// they apply whenever the config doesn't set its own
+		flagMb   int
+		flagSoft int
+	}{}
+
+	cacheDroppers = struct {
+		lck sync.Mutex
+		m   map[string]func()
+	}{m: map[string]func(){}}
+)
+
+// cacheDropper registers f to be called to drop the cache `name` when memory is running low
+func cacheDropper(name string, f func()) {
+	cacheDroppers.lck.Lock()
+	defer cacheDroppers.lck.Unlock()
+	cacheDroppers.m[name] = f
+}
+
+// dropCaches calls all the registered cache droppers and returns the names of the caches that were dropped
+func dropCaches() []string {
+	// droppers wait on the locks of their caches, so they're called without holding cacheDroppers.lck
+	cacheDroppers.lck.Lock()
+	droppers := make(map[string]func(), len(cacheDroppers.m))
+	for name, f := range cacheDroppers.m {
+		droppers[name] = f
+	}
+	cacheDroppers.lck.Unlock()
+
+	names := []string{}
+	for name, f := range droppers {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					Logf(LogError, nil, "PANIC while dropping cache %s: %v", name, err)
+				}
+			}()
+			f()
+			names = append(names, name)
+		}()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setOomFlagLimits sets the limits, in megabytes, that apply when the config doesn't set its own
+func setOomFlagLimits(mb, soft int) {
+	oomLimit.lck.Lock()
+	defer oomLimit.lck.Unlock()
+	oomLimit.flagMb = mb
+	oomLimit.flagSoft = soft
+}
+
+// oomFlagLimits returns the limits set by setOomFlagLimits
+func oomFlagLimits() (mb, soft int) {
+	oomLimit.lck.Lock()
+	defer oomLimit.lck.Unlock()
+	return oomLimit.flagMb, oomLimit.flagSoft
+}
+
+// setOomLimit changes the memory limit, in megabytes, of a running oom killer
+func setOomLimit(mb int) {
+	oomLimit.lck.Lock()
+	defer oomLimit.lck.Unlock()
+	oomLimit.mb = mb
+}
+
+// setOomSoftLimit changes the soft memory limit, in megabytes, of a running oom killer.
+// if mb is zero, the soft limit is oomSoftPercent of the hard limit
+func setOomSoftLimit(mb int) {
+	oomLimit.lck.Lock()
+	defer oomLimit.lck.Unlock()
+	oomLimit.soft = mb
+}
+
+// oomLimits returns the soft and hard memory limits in megabytes
+func oomLimits() (soft int, hard int) {
+	oomLimit.lck.Lock()
+	defer oomLimit.lck.Unlock()
+
+	hard = oomLimit.mb
+	soft = oomLimit.soft
+	if soft <= 0 || soft > hard {
+		soft = hard * oomSoftPercent / 100
+	}
+	return soft, hard
+}
+
+// relieveMemory drops all caches and returns as much memory as possible to the OS.
+// It returns the names of the dropped caches and the live heap, in megabytes, afterwards.
+// If the caches aren't dropped within oomDropTimeout, it stops waiting and none are reported as dropped
+func relieveMemory() ([]string, int) {
+	ch := make(chan []string, 1)
+	go func() {
+		ch <- dropCaches()
+	}()
+
+	dropped := []string{}
+	select {
+	case dropped = <-ch:
+	case <-time.After(oomDropTimeout):
+		Logf(LogWarn, nil, "caches weren't dropped after %v, they may be locked by a call that's hung", oomDropTimeout)
+	}
+
+	runtime.GC()
+	debug.FreeOSMemory()
+
+	var mst runtime.MemStats
+	runtime.ReadMemStats(&mst)
+	return dropped, int(mst.HeapAlloc / (1024 * 1024))
+}
+
 func startOomKiller(maxMb int) {
+	setOomLimit(maxMb)
 	go func() {
-		const M = uint64(1024 * 1024)
+		const MB = uint64(1024 * 1024)
 		runtime.LockOSThread()
 
 		var mst runtime.MemStats
-		buf := make([]byte, 1*M)
+		var lastDrop time.Time
+		buf := make([]byte, 1*MB)
 		f := "MarGo: OOM.\n" +
 			"Memory limit: %vm\n" +
 			"Memory usage: %vm\n" +
@@ -23,10 +156,30 @@ func startOomKiller(maxMb int) {
 
 		for {
 			runtime.ReadMemStats(&mst)
-			alloc := int(mst.Sys / M)
-			if alloc >= maxMb {
-				n := runtime.Stack(buf, true)
-				log.Fatalf(f, maxMb, alloc, runtime.NumGoroutine(), buf[:n])
+			// Sys includes memory the runtime is holding on to but isn't using, so only count the live heap
+			alloc := int(mst.HeapAlloc / MB)
+			soft, hard := oomLimits()
+
+			if alloc >= hard || (alloc >= soft && time.Now().Sub(lastDrop) >= oomDropInterval) {
+				lastDrop = time.Now()
+				dropped, after := relieveMemory()
+
+				Logf(LogWarn, M{"before": alloc, "after": after, "dropped": dropped}, "memory use is high, dropped caches")
+				post(Response{
+					Token: "margo.memory",
+					Data: M{
+						"heap_before": alloc,
+						"heap_after":  after,
+						"soft_limit":  soft,
+						"hard_limit":  hard,
+						"dropped":     dropped,
+					},
+				})
+
+				if after >= hard {
+					n := runtime.Stack(buf, true)
+					log.Fatalf(f, hard, after, runtime.NumGoroutine(), buf[:n])
+				}
 			}
 			time.Sleep(time.Second * 2)
 		}
@@ -3,16 +3,12 @@ package main
 import (
 	"go/parser"
 	"go/token"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 )
 
-var (
-	buildIgnore = regexp.MustCompile(`^\W*[+]build.*?\bignore\b`)
-)
-
 func ignoreNm(name string) bool {
 	if name == "" || name[0] == '.' || name[0] == '_' {
 		return true
@@ -39,12 +35,26 @@ func ls(fn string) ([]string, bool) {
 	return names, (err == nil || len(names) > 0)
 }
 
-func walk(root string, ch chan string, dir string) {
+// walk sends the names of the Go files below dir to ch.
+// If mods is true, directories that contain another module, i.e. a go.mod file, are skipped
+func walk(cx *Ctx, root string, ch chan string, dir string, mods bool) {
+	if cx.Canceled() {
+		return
+	}
+
 	names, ok := ls(dir)
 	if !ok {
 		return
 	}
 
+	if mods && dir != root {
+		for _, nm := range names {
+			if nm == "go.mod" {
+				return
+			}
+		}
+	}
+
 	for _, nm := range names {
 		if ignoreNm(nm) {
 			continue
@@ -54,13 +64,17 @@ func walk(root string, ch chan string, dir string) {
 		isFx, isGo := fx(nm)
 		if isGo {
 			ch <- fn
-		} else if !isFx {
-			walk(root, ch, fn)
+		} else if !isFx && nm != "vendor" {
+			// vendored packages aren't importable by their path in the tree, their vendor dir is a root of its own
+			walk(cx, root, ch, fn, mods)
 		}
 	}
 }
 
-func pkgPaths(srcDir string, exclude []string) map[string]string {
+// pkgPaths returns the import paths and names of the packages in root.
+// root.Path is empty for GOPATH and GOROOT dirs and the module path otherwise
+func pkgPaths(cx *Ctx, root srcRoot, bf *buildFilter, exclude []string) map[string]string {
+	srcDir := root.Dir
 	paths := map[string]string{}
 	done := make(chan struct{})
 	ch := make(chan string, 100)
@@ -75,10 +89,10 @@ func pkgPaths(srcDir string, exclude []string) map[string]string {
 	proc := func(fn string) {
 		dir := filepath.Dir(fn)
 		p, err := filepath.Rel(srcDir, dir)
-		if err != nil || strings.HasPrefix(p, ".") {
+		if err != nil || (strings.HasPrefix(p, ".") && (p != "." || root.Path == "")) {
 			return
 		}
-		p = filepath.ToSlash(p)
+		p = root.importPath(filepath.ToSlash(p))
 
 		if _, ok := paths[p]; ok {
 			return
@@ -88,21 +102,21 @@ func pkgPaths(srcDir string, exclude []string) map[string]string {
 			return
 		}
 
-		af, _ := parser.ParseFile(fset, fn, nil, parser.ImportsOnly|parser.ParseComments)
+		if !bf.MatchName(filepath.Base(fn)) {
+			return
+		}
+		src, err := ioutil.ReadFile(fn)
+		if err != nil || !bf.MatchSrc(src) {
+			return
+		}
+
+		af, _ := parser.ParseFile(fset, fn, src, parser.PackageClauseOnly)
 		if af == nil || af.Name == nil {
 			return
 		}
 
 		name := af.Name.String()
 
-		for _, cg := range af.Comments {
-			for _, c := range cg.List {
-				if buildIgnore.MatchString(c.Text) {
-					return
-				}
-			}
-		}
-
 		if _, skip := excluded[name]; skip {
 			seen[p] = void{}
 			return
@@ -118,7 +132,7 @@ func pkgPaths(srcDir string, exclude []string) map[string]string {
 		}
 	}()
 
-	walk(srcDir, ch, srcDir)
+	walk(cx, srcDir, ch, srcDir, root.Path != "")
 	close(ch)
 	<-done
 
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// pluginRestartDelay is the minimum time between starts of a plugin's process,
+	// it stops a plugin that dies immediately from being restarted on every request
+	pluginRestartDelay = 1 * time.Second
+
+	// pluginBroadcasts are the tokens of the responses a plugin may send to every client
+	pluginBroadcasts = map[string]bool{
+		"margo.message": true,
+	}
+)
+
+// pluginConfig describes an external executable that provides methods.
+// It's spawned on demand and sent requests for its methods using the same
+// line protocol that clients use, its responses are forwarded to the client.
+type pluginConfig struct {
+	Name    string            `json:"name"`
+	Cmd     []string          `json:"cmd"`
+	Dir     string            `json:"dir"`
+	Env     map[string]string `json:"env"`
+	Methods []string          `json:"methods"`
+	Class   string            `json:"class"`
+	Timeout string            `json:"timeout"`
+}
+
+type plugin struct {
+	pluginConfig
+
+	lck     sync.Mutex
+	wLck    sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	started time.Time
+	pending map[string]*pluginCall
+	tokens  counter
+}
+
+type pluginCall struct {
+	res  chan Response
+	done chan struct{}
+}
+
+type mPlugin struct {
+	p      *plugin
+	b      *Broker
+	method string
+	args   json.RawMessage
+}
+
+// loadPlugins registers the methods of the plugins configured in fn.
+// fn is either a json file with a list of plugins `{"plugins": [...]}`
+// or a directory in which each .json file configures a single plugin.
+func loadPlugins(fn string) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	cfgs := []pluginConfig{}
+	if fi.IsDir() {
+		l, _ := filepath.Glob(filepath.Join(fn, "*.json"))
+		for _, cfgFn := range l {
+			cfg := pluginConfig{}
+			if err := readJsonFile(cfgFn, &cfg); err != nil {
+				return err
+			}
+			if cfg.Name == "" {
+				cfg.Name = strings.TrimSuffix(filepath.Base(cfgFn), ".json")
+			}
+			cfgs = append(cfgs, cfg)
+		}
+	} else {
+		v := struct {
+			Plugins []pluginConfig `json:"plugins"`
+		}{}
+		if err := readJsonFile(fn, &v); err != nil {
+			return err
+		}
+		cfgs = v.Plugins
+	}
+
+	// relative paths are relative to the config, not wherever MarGo happens to be started
+	dir := fn
+	if !fi.IsDir() {
+		dir = filepath.Dir(fn)
+	}
+	for _, cfg := range cfgs {
+		if len(cfg.Cmd) > 0 && strings.ContainsRune(cfg.Cmd[0], filepath.Separator) && !filepath.IsAbs(cfg.Cmd[0]) {
+			cfg.Cmd[0] = filepath.Join(dir, cfg.Cmd[0])
+		}
+		if cfg.Dir != "" && !filepath.IsAbs(cfg.Dir) {
+			cfg.Dir = filepath.Join(dir, cfg.Dir)
+		}
+
+		if err := registerPlugin(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readJsonFile(fn string, v interface{}) error {
+	s, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(s, v); err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	return nil
+}
+
+func registerPlugin(cfg pluginConfig) error {
+	if cfg.Name == "" {
+		return errors.New("plugin has no name")
+	}
+	if len(cfg.Cmd) == 0 {
+		return errors.New("plugin " + cfg.Name + " has no cmd")
+	}
+
+	class, ok := parseMethodClass(orString(cfg.Class, Background.String()))
+	if !ok {
+		return errors.New("plugin " + cfg.Name + " has an invalid class " + cfg.Class)
+	}
+
+	var timeout time.Duration
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return fmt.Errorf("plugin %s has an invalid timeout: %v", cfg.Name, err)
+		}
+		timeout = d
+	}
+
+	p := &plugin{
+		pluginConfig: cfg,
+		pending:      map[string]*pluginCall{},
+	}
+	for _, name := range cfg.Methods {
+		if registry.Lookup(name) != nil {
+			return errors.New("plugin " + cfg.Name + " cannot provide method " + name + ", it's already registered")
+		}
+		method := name
+		registry.RegisterClass(name, class, func(b *Broker) Caller {
+			return &mPlugin{p: p, b: b, method: method}
+		})
+		if timeout > 0 {
+			methodTimeouts[name] = timeout
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON keeps the arguments as-is, they're for the plugin to decode
+func (m *mPlugin) UnmarshalJSON(s []byte) error {
+	m.args = append(json.RawMessage(nil), s...)
+	return nil
+}
+
+func (m *mPlugin) MarshalJSON() ([]byte, error) {
+	if len(m.args) == 0 {
+		return []byte("{}"), nil
+	}
+	return m.args, nil
+}
+
+func (m *mPlugin) Call(cx *Ctx) (interface{}, string) {
+	return m.p.call(cx, m.b, m.method, m.args)
+}
+
+func (p *plugin) cid() string {
+	return "plugin." + p.Name
+}
+
+// start starts the plugin's process if it's not already running
+func (p *plugin) start() error {
+	if p.cmd != nil {
+		return nil
+	}
+
+	if d := time.Now().Sub(p.started); d < pluginRestartDelay {
+		return fmt.Errorf("plugin %s exited less than %v after it was started", p.Name, d)
+	}
+
+	env := environ()
+	for k, v := range p.Env {
+		env[k] = v
+	}
+
+	c := exec.Command(p.Cmd[0], p.Cmd[1:]...)
+	c.Dir = p.Dir
+	c.Env = envSlice(env)
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := c.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	p.started = time.Now()
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	// a previous process may still be registered if it hasn't been reaped yet
+	unwatchCmd(p.cid())
+	watchCmd(p.cid(), c)
+	p.cmd = c
+	p.stdin = stdin
+
+	go p.logStderr(stderr)
+	go p.read(c, stdout)
+	return nil
+}
+
+// read routes the responses of the process c to the calls waiting on them until it exits
+func (p *plugin) read(c *exec.Cmd, stdout io.Reader) {
+	dec := json.NewDecoder(bufio.NewReader(stdout))
+	for {
+		resp := Response{}
+		if err := dec.Decode(&resp); err != nil {
+			if err != io.EOF {
+				Logf(LogWarn, M{"plugin": p.Name}, "plugin: cannot decode response: %v", err)
+			}
+			break
+		}
+
+		if m, ok := resp.Data.(map[string]interface{}); ok {
+			resp.Data = M(m)
+		}
+
+		p.lck.Lock()
+		pc := p.pending[resp.Token]
+		p.lck.Unlock()
+
+		switch {
+		case pc != nil:
+			select {
+			case pc.res <- resp:
+			case <-pc.done:
+			}
+		case pluginBroadcasts[resp.Token]:
+			post(resp)
+		default:
+			// the reply to a call that was canceled or timed out, only its client may see it
+			Logf(LogDebug, M{"plugin": p.Name, "token": resp.Token}, "plugin: dropped response to an unknown call")
+		}
+	}
+
+	err := c.Wait()
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	if p.cmd == c {
+		p.cmd = nil
+		p.stdin = nil
+		unwatchCmd(p.cid())
+	}
+
+	e := "plugin " + p.Name + " exited"
+	if err != nil {
+		e += ": " + err.Error()
+	}
+	Logf(LogWarn, M{"plugin": p.Name}, "%s", e)
+
+	for token, pc := range p.pending {
+		delete(p.pending, token)
+		select {
+		case pc.res <- Response{Token: token, Error: e}:
+		case <-pc.done:
+		}
+	}
+}
+
+func (p *plugin) logStderr(stderr io.Reader) {
+	sc := bufio.NewScanner(stderr)
+	for sc.Scan() {
+		Logf(LogInfo, M{"plugin": p.Name}, "plugin: %s", sc.Text())
+	}
+}
+
+func (p *plugin) send(req M, args json.RawMessage) error {
+	s, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	s = append(s, args...)
+	s = append(s, '\n')
+
+	p.lck.Lock()
+	stdin := p.stdin
+	p.lck.Unlock()
+	if stdin == nil {
+		return errors.New("plugin " + p.Name + " is not running")
+	}
+
+	p.wLck.Lock()
+	defer p.wLck.Unlock()
+	_, err = stdin.Write(s)
+	return err
+}
+
+func (p *plugin) call(cx *Ctx, b *Broker, method string, args json.RawMessage) (interface{}, string) {
+	// tokens are unique per plugin, not per client, so they're replaced with our own
+	token := p.cid() + "." + p.tokens.nextString()
+	pc := &pluginCall{
+		res:  make(chan Response, 1),
+		done: make(chan struct{}),
+	}
+
+	p.lck.Lock()
+	err := p.start()
+	if err == nil {
+		p.pending[token] = pc
+	}
+	p.lck.Unlock()
+	if err != nil {
+		return M{}, err.Error()
+	}
+
+	defer func() {
+		close(pc.done)
+		p.lck.Lock()
+		delete(p.pending, token)
+		p.lck.Unlock()
+	}()
+
+	req := M{
+		"token":  token,
+		"method": method,
+	}
+	if cx != nil && !cx.deadline.IsZero() {
+		req["deadline"] = cx.deadline
+	}
+	if err := p.send(req, args); err != nil {
+		return M{}, err.Error()
+	}
+
+	for {
+		select {
+		case resp := <-pc.res:
+			// streamed frames are forwarded to the client as they come
+			if data, ok := resp.Data.(M); ok && data["done"] == false && cx != nil && cx.Token != "" {
+				b.Send(Response{
+					Token: cx.Token,
+					Error: resp.Error,
+					Data:  data,
+				})
+				continue
+			}
+			return resp.Data, resp.Error
+		case <-cx.Done():
+			p.send(M{"method": "cancel"}, json.RawMessage(`{"token":`+jsonString(token)+`}`))
+			return M{}, cx.Err()
+		}
+	}
+}
+
+func jsonString(s string) string {
+	v, _ := json.Marshal(s)
+	return string(v)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// poolSizes are the number of workers and the queue capacity of each class of method
+	poolSizes = map[MethodClass]struct{ workers, queue int }{
+		Interactive: {8, 500},
+		Background:  {4, 100},
+		Spawning:    {8, 100},
+	}
+)
+
+// pool is a bounded queue of jobs and the workers that call them.
+// each class of method has its own pool so e.g. a batch of `sh` commands can't starve completion
+type pool struct {
+	class   MethodClass
+	workers int
+	jobs    chan Job
+	// slots limits the number of calls running at once. a call that's abandoned after its deadline
+	// keeps its slot until it returns, so calls that never return can't pile up beyond the size of the pool
+	slots     chan struct{}
+	lck       sync.Mutex
+	busy      int
+	abandoned int
+	stopped   bool
+}
+
+func newPool(class MethodClass) *pool {
+	workers, queue := poolSize(class)
+	return &pool{
+		class:   class,
+		workers: workers,
+		jobs:    make(chan Job, queue),
+		slots:   make(chan struct{}, workers),
+	}
+}
+
+// enqueue adds job to the queue, it returns false if the queue is full or the pool was stopped
+func (p *pool) enqueue(job Job) bool {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	if p.stopped {
+		return false
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *pool) start(b *Broker, wg *sync.WaitGroup) {
+	for i := 0; i < p.workers; i += 1 {
+		wg.Add(1)
+		go p.worker(b, wg)
+	}
+}
+
+func (p *pool) worker(b *Broker, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for job := range p.jobs {
+		p.setBusy(+1)
+		b.call(p, job)
+		p.setBusy(-1)
+	}
+}
+
+// stop closes the queue, the workers exit once they've called the jobs that are already in it
+func (p *pool) stop() {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	if !p.stopped {
+		p.stopped = true
+		close(p.jobs)
+	}
+}
+
+// acquire waits for a free slot. It returns false if cx is canceled or timeout fires first
+func (p *pool) acquire(cx *Ctx, timeout <-chan time.Time) bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-cx.Done():
+	case <-timeout:
+	}
+	return false
+}
+
+func (p *pool) release() {
+	<-p.slots
+}
+
+// abandon counts a call that's still running after its result was given up on as abandoned
+// until it returns its result on resCh
+func (p *pool) abandon(resCh <-chan Response) int {
+	p.lck.Lock()
+	p.abandoned += 1
+	n := p.abandoned
+	p.lck.Unlock()
+
+	go func() {
+		<-resCh
+		p.lck.Lock()
+		p.abandoned -= 1
+		p.lck.Unlock()
+	}()
+	return n
+}
+
+func (p *pool) setBusy(n int) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	p.busy += n
+}
+
+func (p *pool) status() M {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	return M{
+		"workers":   p.workers,
+		"busy":      p.busy,
+		"queued":    len(p.jobs),
+		"capacity":  cap(p.jobs),
+		"abandoned": p.abandoned,
+	}
+}
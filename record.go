@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// trafficRec, if set, records the traffic of all brokers
+	trafficRec *recorder
+
+	// replayVolatile are the keys of results that are expected to differ between runs
+	replayVolatile = map[string]bool{
+		"dur":    true,
+		"time":   true,
+		"start":  true,
+		"end":    true,
+		"uptime": true,
+		"tmpFn":  true,
+	}
+)
+
+type recordEntry struct {
+	Kind string `json:"kind"`
+	// Conn identifies the connection, the client, of the request or response
+	Conn   uint64    `json:"conn"`
+	Time   time.Time `json:"time"`
+	Token  string    `json:"token"`
+	Method string    `json:"method,omitempty"`
+	Line   string    `json:"line,omitempty"`
+	Dur    string    `json:"dur,omitempty"`
+	Resp   *Response `json:"resp,omitempty"`
+}
+
+// recordKey identifies a request, tokens are only unique per client so it includes the client's connection
+type recordKey struct {
+	conn  uint64
+	token string
+}
+
+// recorder writes requests and responses to a file, one json object per line
+type recorder struct {
+	lck   sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	start map[recordKey]time.Time
+}
+
+func newRecorder(fn string) (*recorder, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &recorder{
+		f:     f,
+		enc:   json.NewEncoder(f),
+		start: map[recordKey]time.Time{},
+	}
+	byeDefer(func() {
+		r.lck.Lock()
+		defer r.lck.Unlock()
+		r.f.Close()
+	})
+	return r, nil
+}
+
+// request records line, the header and body of a request received by b
+func (r *recorder) request(b *Broker, req *Request, line []byte) {
+	if r == nil {
+		return
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	now := time.Now()
+	if req.Token != "" {
+		r.start[recordKey{b.id, req.Token}] = now
+	}
+	r.enc.Encode(recordEntry{
+		Kind:   "request",
+		Conn:   b.id,
+		Time:   now,
+		Token:  req.Token,
+		Method: req.Method,
+		Line:   string(bytes.TrimSpace(redactLine(req, line))),
+	})
+}
+
+// redactLine removes the shared secret from the line of a `hello` request so it's never written to the file
+func redactLine(req *Request, line []byte) []byte {
+	if req.Method != "hello" {
+		return line
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(line))
+	header := json.RawMessage{}
+	if err := dec.Decode(&header); err != nil {
+		return nil
+	}
+	args := M{}
+	if err := dec.Decode(&args); err != nil {
+		return header
+	}
+	delete(args, "secret")
+	s, _ := json.Marshal(args)
+	return append(append(header, ' '), s...)
+}
+
+// response records resp and how long after its request to b it was sent
+func (r *recorder) response(b *Broker, resp Response) {
+	if r == nil {
+		return
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	now := time.Now()
+	e := recordEntry{
+		Kind:  "response",
+		Conn:  b.id,
+		Time:  now,
+		Token: resp.Token,
+		Resp:  &resp,
+	}
+	k := recordKey{b.id, resp.Token}
+	if t, ok := r.start[k]; ok {
+		e.Dur = now.Sub(t).String()
+		// streamed responses share a token so it's only forgotten when the final response is sent
+		if data, ok := resp.Data.(M); !ok || data["done"] != false {
+			delete(r.start, k)
+		}
+	}
+	r.enc.Encode(e)
+}
+
+// replayConn holds the recorded traffic of one connection
+type replayConn struct {
+	input    bytes.Buffer
+	methods  map[string]string
+	recorded map[string][]interface{}
+}
+
+// replay calls the requests recorded in fn and compares the responses with the recorded ones.
+// Each connection is replayed in order through its own broker so their tokens and state e.g. capabilities don't mix.
+// differences are written to w and the number of requests whose responses differ is returned
+func replay(fn string, tag string, w io.Writer) (int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	conns := map[uint64]*replayConn{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64*1024*1024)
+	for sc.Scan() {
+		e := recordEntry{}
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return 0, err
+		}
+
+		rc := conns[e.Conn]
+		if rc == nil {
+			rc = &replayConn{
+				methods:  map[string]string{},
+				recorded: map[string][]interface{}{},
+			}
+			conns[e.Conn] = rc
+		}
+
+		switch e.Kind {
+		case "request":
+			rc.input.WriteString(e.Line)
+			rc.input.WriteByte('\n')
+			rc.methods[e.Token] = e.Method
+		case "response":
+			if replayable(e.Token) {
+				rc.recorded[e.Token] = append(rc.recorded[e.Token], replayResp(e.Resp))
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+
+	ids := []uint64{}
+	for id, _ := range conns {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	enc := json.NewEncoder(w)
+	requests := 0
+	diffs := 0
+	for _, id := range ids {
+		rc := conns[id]
+		out := &bytes.Buffer{}
+		b := NewBroker(&rc.input, out, tag)
+		b.Loop(false, true)
+
+		replayed := map[string][]interface{}{}
+		dec := json.NewDecoder(out)
+		for {
+			resp := &Response{}
+			if err := dec.Decode(resp); err != nil {
+				break
+			}
+			if replayable(resp.Token) {
+				replayed[resp.Token] = append(replayed[resp.Token], replayResp(resp))
+			}
+		}
+
+		tokens := []string{}
+		for token, _ := range rc.methods {
+			if replayable(token) {
+				tokens = append(tokens, token)
+			}
+		}
+		sort.Strings(tokens)
+
+		requests += len(tokens)
+		for _, token := range tokens {
+			if !reflect.DeepEqual(rc.recorded[token], replayed[token]) {
+				diffs += 1
+				enc.Encode(M{
+					"conn":     id,
+					"token":    token,
+					"method":   rc.methods[token],
+					"recorded": rc.recorded[token],
+					"replayed": replayed[token],
+				})
+			}
+		}
+	}
+	fmt.Fprintf(w, "replayed %d requests, %d differ\n", requests, diffs)
+	return diffs, nil
+}
+
+func replayable(token string) bool {
+	return token != "" && !strings.HasPrefix(token, "margo.")
+}
+
+// replayResp returns the parts of resp that are expected to be reproducible
+func replayResp(resp *Response) interface{} {
+	var v interface{}
+	s, _ := json.Marshal(M{
+		"error": resp.Error,
+		"data":  resp.Data,
+	})
+	json.Unmarshal(s, &v)
+	return stripVolatile(v)
+}
+
+func stripVolatile(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, v := range x {
+			if replayVolatile[k] {
+				delete(x, k)
+			} else {
+				x[k] = stripVolatile(v)
+			}
+		}
+	case []interface{}:
+		for i, v := range x {
+			x[i] = stripVolatile(v)
+		}
+	}
+	return v
+}
@@ -1,25 +1,93 @@
 package main
 
 import (
+	"sort"
 	"sync"
 )
 
 var (
-	registry = &Registry{m: map[string]Method{}}
+	registry = &Registry{
+		m:     map[string]Method{},
+		class: map[string]MethodClass{},
+	}
 )
 
 type Method func(*Broker) Caller
 
+// Caller is the decoded request of a method.
+// cx is canceled when the client is no longer interested in the result,
+// long-running calls are expected to check it and return early.
 type Caller interface {
-	Call() (res interface{}, err string)
+	Call(cx *Ctx) (res interface{}, err string)
+}
+
+// MethodClass determines which of the broker's worker pools calls a method
+type MethodClass int
+
+const (
+	// Interactive methods are called while the user waits on the result e.g. completion
+	Interactive MethodClass = iota
+	// Background methods scan the filesystem or the network and may take a while
+	Background
+	// Spawning methods run external commands
+	Spawning
+)
+
+var (
+	methodClasses = []MethodClass{Interactive, Background, Spawning}
+)
+
+func (c MethodClass) String() string {
+	switch c {
+	case Interactive:
+		return "interactive"
+	case Background:
+		return "background"
+	case Spawning:
+		return "spawning"
+	}
+	return "unknown"
 }
 
+func parseMethodClass(s string) (MethodClass, bool) {
+	for _, c := range methodClasses {
+		if c.String() == s {
+			return c, true
+		}
+	}
+	return Interactive, false
+}
+
+// CallFunc calls the next interceptor in the chain or, at the end of it, the method itself
+type CallFunc func() (res interface{}, err string)
+
+// Invocation is a single call of a method as seen by interceptors
+type Invocation struct {
+	B   *Broker
+	Req *Request
+	Cx  *Ctx
+	Cl  Caller
+	// Panic is the value recovered from a panic in the method, if any
+	Panic interface{}
+}
+
+// Interceptor wraps every Caller.Call. It may inspect or modify the call before calling next
+// and its result afterwards, or return without calling next to reject the call.
+type Interceptor func(inv *Invocation, next CallFunc) (res interface{}, err string)
+
 type Registry struct {
-	m   map[string]Method
-	lck sync.RWMutex
+	m            map[string]Method
+	class        map[string]MethodClass
+	interceptors []Interceptor
+	lck          sync.RWMutex
 }
 
+// Register registers an Interactive method
 func (r *Registry) Register(name string, method Method) {
+	r.RegisterClass(name, Interactive, method)
+}
+
+func (r *Registry) RegisterClass(name string, class MethodClass, method Method) {
 	r.lck.Lock()
 	defer r.lck.Unlock()
 
@@ -34,6 +102,7 @@ func (r *Registry) Register(name string, method Method) {
 	}
 
 	r.m[name] = method
+	r.class[name] = class
 }
 
 func (r *Registry) Lookup(name string) Method {
@@ -41,3 +110,48 @@ func (r *Registry) Lookup(name string) Method {
 	defer r.lck.RUnlock()
 	return r.m[name]
 }
+
+func (r *Registry) Class(name string) MethodClass {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+	return r.class[name]
+}
+
+// Names returns the sorted names of all registered methods
+func (r *Registry) Names() []string {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+
+	l := make([]string, 0, len(r.m))
+	for name, _ := range r.m {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Use appends interceptors to the chain. The first interceptor is the outermost,
+// i.e. it's called first and sees the result last.
+func (r *Registry) Use(interceptors ...Interceptor) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.interceptors = append(r.interceptors, interceptors...)
+}
+
+// Call calls inv.Cl through the chain of interceptors
+func (r *Registry) Call(inv *Invocation) (interface{}, string) {
+	r.lck.RLock()
+	l := r.interceptors
+	r.lck.RUnlock()
+
+	next := func() (interface{}, string) {
+		return inv.Cl.Call(inv.Cx)
+	}
+	for i := len(l) - 1; i >= 0; i-- {
+		ic, n := l[i], next
+		next = func() (interface{}, string) {
+			return ic(inv, n)
+		}
+	}
+	return next()
+}
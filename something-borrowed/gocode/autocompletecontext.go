@@ -433,6 +433,9 @@ func find_other_package_files(filename, package_name string) []string {
 		}
 
 		abspath := filepath.Join(dir, stat.Name())
+		if gosublimeGocodeFileFilter != nil && !gosublimeGocodeFileFilter(abspath) {
+			continue
+		}
 		if file_package_name(abspath) == package_name {
 			n := len(out)
 			out = out[:n+1]
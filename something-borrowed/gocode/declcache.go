@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 )
 
@@ -173,6 +174,10 @@ func abs_path_for_package(filename, p string) (string, bool) {
 	if ok {
 		return pkg, true
 	}
+	pkg, ok = find_vendored_file(p, dir)
+	if ok {
+		return pkg, true
+	}
 	return find_global_file(p)
 }
 
@@ -199,6 +204,44 @@ func find_go_dag_package(imp, filedir string) (string, bool) {
 	return "", false
 }
 
+// find_vendored_file looks for the package imp in the vendor directories
+// above filedir and returns the name of its compiled package file in GOPATH/pkg
+func find_vendored_file(imp, filedir string) (string, bool) {
+	gopath := gosublimeGocodeGopath
+	if gopath == "" {
+		gopath = os.Getenv("GOPATH")
+	}
+	pkgdir := gosublimeGocodeOSArch
+	if pkgdir == "" {
+		goarch := os.Getenv("GOARCH")
+		goos := os.Getenv("GOOS")
+		if goarch == "" {
+			goarch = runtime.GOARCH
+		}
+		if goos == "" {
+			goos = runtime.GOOS
+		}
+		pkgdir = fmt.Sprintf("%s_%s", goos, goarch)
+	}
+
+	for _, p := range filepath.SplitList(gopath) {
+		src := filepath.Join(p, "src") + string(filepath.Separator)
+		dir := filepath.Clean(filedir)
+		for strings.HasPrefix(dir+string(filepath.Separator), src) {
+			vendored := filepath.Join(dir, "vendor", imp)
+			if filepath.Base(dir) != "vendor" && file_exists(vendored) {
+				rel := vendored[len(src):]
+				pkg_path := filepath.Join(p, "pkg", pkgdir, rel+".a")
+				if file_exists(pkg_path) {
+					return pkg_path, true
+				}
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+	return "", false
+}
+
 func find_global_file(imp string) (string, bool) {
 	// gocode synthetically generates the builtin package
 	// "unsafe", since the "unsafe.a" package doesn't really exist.
@@ -6,6 +6,11 @@ import (
 
 var (
 	gosublimeGocodeDaemon *daemon
+	// gosublimeGocodeFileFilter reports whether the other files of a package are part of it
+	gosublimeGocodeFileFilter func(filename string) bool
+	// gosublimeGocodeGopath and gosublimeGocodeOSArch select the compiled packages of vendored imports
+	gosublimeGocodeGopath string
+	gosublimeGocodeOSArch string
 )
 
 type GoSublimeGocodeCandidate struct {
@@ -35,6 +40,25 @@ func GoSublimeGocodeComplete(file []byte, filename string, cursor int) []GoSubli
 	return candidates
 }
 
+// GoSublimeGocodeDropCache drops the package and declaration caches.
+// It must not be called while a completion is in progress
+func GoSublimeGocodeDropCache() {
+	gosublimeGocodeDaemon.drop_cache()
+}
+
+// GoSublimeGocodeSetFileFilter sets the function that selects which of the other files in the
+// directory of the completed file are part of its package. If it's nil, all of them are
+func GoSublimeGocodeSetFileFilter(f func(filename string) bool) {
+	gosublimeGocodeFileFilter = f
+}
+
+// GoSublimeGocodeSetPlatform sets the GOPATH and the GOOS_GOARCH directory of its `pkg` directory
+// in which the compiled packages of vendored imports are found. If they're empty, those of the process are used
+func GoSublimeGocodeSetPlatform(gopath, osArch string) {
+	gosublimeGocodeGopath = gopath
+	gosublimeGocodeOSArch = osArch
+}
+
 func GoSublimeGocodeSet(k, v string) {
 	g_config.set_option(k, v)
 }
@@ -10,10 +10,14 @@
 package types
 
 import (
+	"errors"
 	"go/ast"
 	"go/token"
 )
 
+// ErrCanceled is returned by Check if type checking was stopped by closing Context.Cancel.
+var ErrCanceled = errors.New("types: check canceled")
+
 // A Context specifies the supporting context for type checking.
 // An empty Context is a ready-to-use default context.
 type Context struct {
@@ -70,6 +74,10 @@ type Context struct {
 	// given type. Otherwise, DefaultSizeof is called. Sizeof must
 	// implement the size guarantees required by the spec.
 	Sizeof func(Type) int64
+
+	// If Cancel != nil, type checking stops with ErrCanceled
+	// soon after Cancel is closed.
+	Cancel <-chan struct{}
 }
 
 // An Importer resolves import paths to Package objects.
@@ -402,6 +402,16 @@ func (check *checker) decl(decl ast.Decl) {
 // A bailout panic is raised to indicate early termination.
 type bailout struct{}
 
+// canceled terminates checking if the context was canceled.
+func (check *checker) canceled() {
+	select {
+	case <-check.ctxt.Cancel:
+		check.firsterr = ErrCanceled
+		panic(bailout{})
+	default:
+	}
+}
+
 func check(ctxt *Context, fset *token.FileSet, files []*ast.File) (pkg *Package, err error) {
 	// initialize checker
 	check := checker{
@@ -449,6 +459,7 @@ func check(ctxt *Context, fset *token.FileSet, files []*ast.File) (pkg *Package,
 	// typecheck all declarations
 	for _, f := range check.files {
 		for _, d := range f.Decls {
+			check.canceled()
 			check.decl(d)
 		}
 	}
@@ -456,6 +467,7 @@ func check(ctxt *Context, fset *token.FileSet, files []*ast.File) (pkg *Package,
 	// typecheck all function/method bodies
 	// (funclist may grow when checking statements - do not use range clause!)
 	for i := 0; i < len(check.funclist); i++ {
+		check.canceled()
 		f := check.funclist[i]
 		if trace {
 			s := "<function literal>"
@@ -102,6 +102,9 @@ func init() {
 		def(&TypeName{Name: "error", Type: &NamedType{Underlying: &Interface{Methods: []*Method{err}}}})
 	}
 
+	// any is an alias for interface{}
+	def(&TypeName{Name: "any", Type: &Interface{}})
+
 	for _, c := range predeclaredConstants {
 		def(c)
 	}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// the number of recent call durations of each method that percentiles are calculated from
+	statsSamples = 1000
+)
+
+var (
+	methodStatsLck = sync.Mutex{}
+	methodStats    = map[string]*callStats{}
+)
+
+type callStats struct {
+	calls    uint64
+	errors   uint64
+	panics   uint64
+	timeouts uint64
+	canceled uint64
+	rejected uint64
+	durs     []time.Duration
+	next     int
+}
+
+// methodCallStats returns the stats of method. methodStatsLck must be held
+func methodCallStats(method string) *callStats {
+	st := methodStats[method]
+	if st == nil {
+		st = &callStats{}
+		methodStats[method] = st
+	}
+	return st
+}
+
+// recordCall records the outcome of a call of method. err is the error sent to the client,
+// a call that timed out or was canceled is also counted as such
+func recordCall(method string, dur time.Duration, err string, panicked bool) {
+	methodStatsLck.Lock()
+	defer methodStatsLck.Unlock()
+
+	st := methodCallStats(method)
+	st.calls += 1
+	if err != "" {
+		st.errors += 1
+	}
+	if panicked {
+		st.panics += 1
+	}
+	switch err {
+	case "timeout":
+		st.timeouts += 1
+	case "canceled", "superseded":
+		st.canceled += 1
+	}
+
+	if len(st.durs) < statsSamples {
+		st.durs = append(st.durs, dur)
+	} else {
+		st.durs[st.next] = dur
+		st.next = (st.next + 1) % statsSamples
+	}
+}
+
+// recordRejected records a call of method that was refused because its queue was full.
+// It counts as a failed call, but it has no duration
+func recordRejected(method string) {
+	methodStatsLck.Lock()
+	defer methodStatsLck.Unlock()
+
+	st := methodCallStats(method)
+	st.calls += 1
+	st.errors += 1
+	st.rejected += 1
+}
+
+func (st *callStats) summary() M {
+	durs := append([]time.Duration{}, st.durs...)
+	sort.Sort(durations(durs))
+	pct := func(p int) string {
+		if len(durs) == 0 {
+			return "0"
+		}
+		return durs[(len(durs)-1)*p/100].String()
+	}
+
+	return M{
+		"calls":    st.calls,
+		"errors":   st.errors,
+		"panics":   st.panics,
+		"timeouts": st.timeouts,
+		"canceled": st.canceled,
+		"rejected": st.rejected,
+		"p50":      pct(50),
+		"p90":      pct(90),
+		"p99":      pct(99),
+		"max":      pct(100),
+	}
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// methodsStats returns the stats of every method that has been called
+func methodsStats() M {
+	methodStatsLck.Lock()
+	defer methodStatsLck.Unlock()
+
+	m := M{}
+	for name, st := range methodStats {
+		m[name] = st.summary()
+	}
+	return m
+}
+
+// runtimeStats returns the process-wide stats, it's small enough to be sent with every `margo.poll`
+func runtimeStats() M {
+	var mst runtime.MemStats
+	runtime.ReadMemStats(&mst)
+
+	methodStatsLck.Lock()
+	calls := uint64(0)
+	errors := uint64(0)
+	for _, st := range methodStats {
+		calls += st.calls
+		errors += st.errors
+	}
+	methodStatsLck.Unlock()
+
+	return M{
+		"queued":     queueDepths(),
+		"goroutines": runtime.NumGoroutine(),
+		"heap_alloc": mst.HeapAlloc,
+		"sys":        mst.Sys,
+		"num_gc":     mst.NumGC,
+		"calls":      calls,
+		"errors":     errors,
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"os/exec"
+	"sync"
+	"unicode/utf8"
+)
+
+// Stream sends partial results of a call to the client as separate responses under
+// the token of the request. Every frame carries a `seq` number and `done: false`,
+// the final response of the call is the `done` frame returned by Stream.Done.
+type Stream struct {
+	lck     sync.Mutex
+	cx      *Ctx
+	seq     uint64
+	writers []*streamWriter
+}
+
+type streamWriter struct {
+	st   *Stream
+	name string
+	rest []byte
+}
+
+// newStream returns a stream for the request cx or nil if the client has no way
+// of identifying the frames i.e. the request has no token
+func newStream(cx *Ctx) *Stream {
+	if cx == nil || cx.Token == "" {
+		return nil
+	}
+	return &Stream{
+		cx: cx,
+	}
+}
+
+// Writer returns a writer whose writes are sent to the client as frames
+// with the data stored in key `name`, e.g. `out` or `err`
+func (st *Stream) Writer(name string) io.Writer {
+	st.lck.Lock()
+	defer st.lck.Unlock()
+
+	w := &streamWriter{
+		st:   st,
+		name: name,
+	}
+	st.writers = append(st.writers, w)
+	return w
+}
+
+func (st *Stream) send(data M) {
+	st.lck.Lock()
+	defer st.lck.Unlock()
+
+	// the client has been sent the cancellation error, it's not expecting any more frames
+	if st.cx.Canceled() {
+		return
+	}
+
+	st.seq += 1
+	data["seq"] = st.seq
+	data["done"] = false
+	st.cx.b.Send(Response{
+		Token: st.cx.Token,
+		Data:  data,
+	})
+}
+
+// Done flushes any pending output and turns res into the final frame of the stream
+func (st *Stream) Done(res M) M {
+	st.lck.Lock()
+	writers := st.writers
+	st.writers = nil
+	st.lck.Unlock()
+
+	for _, w := range writers {
+		w.flush()
+	}
+
+	st.lck.Lock()
+	defer st.lck.Unlock()
+
+	st.seq += 1
+	res["seq"] = st.seq
+	res["done"] = true
+	return res
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	s := append(w.rest, p...)
+
+	// don't split a rune across frames, jData would mangle both halves
+	i := len(s)
+	for j := len(s) - 1; j >= 0 && j >= len(s)-utf8.UTFMax; j-- {
+		if utf8.RuneStart(s[j]) {
+			if !utf8.FullRune(s[j:]) {
+				i = j
+			}
+			break
+		}
+	}
+
+	w.rest = append([]byte(nil), s[i:]...)
+	if i > 0 {
+		w.st.send(M{
+			w.name: jData(s[:i]),
+		})
+	}
+	return n, nil
+}
+
+func (w *streamWriter) flush() {
+	if len(w.rest) > 0 {
+		s := w.rest
+		w.rest = nil
+		w.st.send(M{
+			w.name: jData(s),
+		})
+	}
+}
+
+func exitStatus(c *exec.Cmd) int {
+	if c.ProcessState == nil {
+		return -1
+	}
+	return c.ProcessState.ExitCode()
+}
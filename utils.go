@@ -6,8 +6,10 @@ import (
 	"strings"
 )
 
-const goosList = "darwin freebsd linux netbsd openbsd plan9 windows "
-const goarchList = "386 amd64 arm "
+// goosList, goarchList and unixList are the same as those of go/build
+const goosList = "aix android darwin dragonfly freebsd hurd illumos ios js linux nacl netbsd openbsd plan9 solaris wasip1 windows zos "
+const goarchList = "386 amd64 amd64p32 arm armbe arm64 arm64be loong64 mips mipsle mips64 mips64le mips64p32 mips64p32le ppc ppc64 ppc64le riscv riscv64 s390 s390x sparc sparc64 wasm "
+const unixList = "aix android darwin dragonfly freebsd hurd illumos ios linux netbsd openbsd solaris "
 
 // goodOSArchFile returns false if the name contains a $GOOS or $GOARCH
 // suffix which does not match the current system.
@@ -43,6 +45,7 @@ func isOSArchFile(ctxt *build.Context, name string) bool {
 
 var knownOS = make(map[string]bool)
 var knownArch = make(map[string]bool)
+var unixOS = make(map[string]bool)
 
 func init() {
 	for _, v := range strings.Fields(goosList) {
@@ -51,4 +54,7 @@ func init() {
 	for _, v := range strings.Fields(goarchList) {
 		knownArch[v] = true
 	}
+	for _, v := range strings.Fields(unixList) {
+		unixOS[v] = true
+	}
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// findVendorDirs returns the vendor directories that packages in dir may import from,
+// innermost first, as the go command does in GOPATH mode: only those between dir
+// and the src directory of the GOPATH entry that contains it are used
+func findVendorDirs(dir string, gopath string) []string {
+	if dir == "" || !filepath.IsAbs(dir) {
+		return nil
+	}
+
+	dir = filepath.Clean(dir)
+	srcDir := ""
+	for _, p := range filepath.SplitList(gopath) {
+		src := filepath.Join(p, "src")
+		if p != "" && (dir == src || strings.HasPrefix(dir, src+string(filepath.Separator))) {
+			srcDir = src
+			break
+		}
+	}
+	if srcDir == "" {
+		return nil
+	}
+
+	dirs := []string{}
+	for {
+		// the vendor dir of a vendored package is visible, but not the vendor dir itself
+		if filepath.Base(dir) != "vendor" {
+			vdir := filepath.Join(dir, "vendor")
+			if fi, err := os.Stat(vdir); err == nil && fi.IsDir() {
+				dirs = append(dirs, vdir)
+			}
+		}
+
+		if dir == srcDir {
+			return dirs
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// modVendorDir returns the vendor directory of the module or workspace in root
+// if the go command would build from it instead of the module cache
+func modVendorDir(root string, env map[string]string) string {
+	for _, s := range strings.Fields(orString(env["GOFLAGS"], os.Getenv("GOFLAGS"))) {
+		switch s {
+		case "-mod=mod", "-mod=readonly":
+			return ""
+		}
+	}
+
+	vdir := filepath.Join(root, "vendor")
+	if fi, err := os.Stat(filepath.Join(vdir, "modules.txt")); err == nil && !fi.IsDir() {
+		return vdir
+	}
+	return ""
+}